@@ -0,0 +1,448 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+)
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+type deviceInfo struct {
+	Serial       string         `json:"serial"`
+	Silver       bool           `json:"silver"`
+	Extension    string         `json:"extension,omitempty"`
+	OffHook      bool           `json:"offHook"`
+	Ringing      bool           `json:"ringing"`
+	DoNotDisturb bool           `json:"dnd"`
+	Audio        audioDeviceIds `json:"audio"`
+	Client       string         `json:"client,omitempty"` // client type using the phone
+	Dialer       string         `json:"dialer,omitempty"`
+}
+
+type ringingInfo struct {
+	ID       string        `json:"id"`
+	Client   string        `json:"client"`
+	CallerID *calleridData `json:"callerId,omitempty"`
+	Devices  []string      `json:"devices"` // serials of the devices ringing for the call
+	Started  time.Time     `json:"started"`
+}
+
+type testRingData struct {
+	CallerID *calleridData `json:"callerId"`
+	Cadence  string        `json:"cadence"`
+}
+
+type originateData struct {
+	Dialer string `json:"dialer"`
+	Number string `json:"number"`
+}
+
+type originateResult struct {
+	State string `json:"state"`        // calling, or ringing until the handset is picked up
+	ID    string `json:"id,omitempty"` // id of the ring, if ringing
+}
+
+type originateRequest struct {
+	dialer string
+	client string
+	number string
+}
+
+// apiClient answers rings started from the REST API, placing the call for originate requests
+type apiClient struct {
+	originating map[string]originateRequest // ring id -> call to place once the device answers
+}
+
+var api = &apiClient{originating: make(map[string]originateRequest)}
+
+func (c *apiClient) Call(_ *device, _ callData, _ string) {
+}
+
+func (c *apiClient) End(_ *device, _ uuid.UUID) {
+}
+
+func (c *apiClient) Answer(d *device, data callAnswerData) {
+	d.clientUsingPhone = ""
+	d.clientConnection = uuid.Nil
+	d.activeCall = nil
+
+	request, ok := c.originating[data.ID]
+	if !ok {
+		// a test ring, picking up behaves as if the phone wasn't ringing
+		d.startDialTone()
+		return
+	}
+
+	delete(c.originating, data.ID)
+
+	d.dialer = request.dialer
+	d.call(request.client, request.number)
+}
+
+func (c *apiClient) Missed(data ringData) {
+	delete(c.originating, data.ID)
+}
+
+func (c *apiClient) DoNotDisturb(data ringData) {
+	delete(c.originating, data.ID)
+}
+
+func (c *apiClient) Cancelled(data ringData) {
+	delete(c.originating, data.ID)
+}
+
+func (c *apiClient) Conference(_ *device, _ conferenceData) {
+}
+
+func (c *apiClient) Transfer(_ *device, _ *device, _ transferData) bool {
+	return false
+}
+
+func (c *apiClient) Hold(_ *device, _ uuid.UUID) {
+}
+
+func (c *apiClient) Resume(_ *device, _ uuid.UUID) {
+}
+
+func (c *apiClient) InUse(_ *device) bool {
+	return false
+}
+
+// resolve finds the client and number a dialer would call, as if the number was dialed on the handset
+func (o originateData) resolve() (originateRequest, error) {
+	dialer, ok := config.Dialers[o.Dialer]
+	if !ok {
+		return originateRequest{}, fmt.Errorf("unknown dialer %s", o.Dialer)
+	}
+
+	if data, ok := dialer.Map[o.Number]; ok {
+		return originateRequest{dialer: o.Dialer, client: data[0], number: data[1]}, nil
+	}
+
+	if dialer.Client == "" || o.Number == "" {
+		return originateRequest{}, fmt.Errorf("dialer %s can't call %s", o.Dialer, o.Number)
+	}
+
+	return originateRequest{dialer: o.Dialer, client: dialer.Client, number: o.Number}, nil
+}
+
+func deviceBySerial(serial string) *device {
+	for _, d := range devices {
+		if d.serial == serial {
+			return d
+		}
+	}
+
+	return nil
+}
+
+// apiDevice finds the device of a request, writing the error response if it doesn't exist or the token can't use it. mu must be held
+func apiDevice(w http.ResponseWriter, r *http.Request, token *apiToken) (*device, bool) {
+	d := deviceBySerial(chi.URLParam(r, "serial"))
+	if d == nil {
+		render.Status(r, http.StatusNotFound)
+		render.PlainText(w, r, "device not found")
+		return nil, false
+	}
+
+	if !token.allowsDevice(d) {
+		render.Status(r, http.StatusForbidden)
+		render.PlainText(w, r, "token can't use this device")
+		return nil, false
+	}
+
+	return d, true
+}
+
+// ringable checks an on-hook device can be rung, writing the error response if it's already ringing or in do not disturb. mu must be held
+func ringable(w http.ResponseWriter, r *http.Request, d *device) bool {
+	if d.ringing {
+		render.Status(r, http.StatusConflict)
+		render.PlainText(w, r, "device is ringing")
+		return false
+	}
+
+	if d.doNotDisturb() {
+		render.Status(r, http.StatusConflict)
+		render.PlainText(w, r, "device is in do not disturb")
+		return false
+	}
+
+	return true
+}
+
+func handleDevices(w http.ResponseWriter, r *http.Request) {
+	_, ok := authorize(w, r, "admin")
+	if !ok {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	list := []deviceInfo{}
+
+	for _, d := range devices {
+		_, ringIndex := ringing.Ringing(d)
+
+		list = append(list, deviceInfo{
+			Serial:       d.serial,
+			Silver:       d.silver,
+			Extension:    d.config().Extension,
+			OffHook:      d.inUse,
+			Ringing:      ringIndex != -1 && !d.inUse,
+			DoNotDisturb: d.doNotDisturb(),
+			Audio:        d.audioDeviceIds,
+			Client:       d.clientUsingPhone,
+			Dialer:       d.dialer,
+		})
+	}
+
+	render.JSON(w, r, list)
+}
+
+func handleRinging(w http.ResponseWriter, r *http.Request) {
+	_, ok := authorize(w, r, "admin")
+	if !ok {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	list := []ringingInfo{}
+
+	for _, ringData := range ringing {
+		serials := []string{}
+		for _, d := range ringData.devices {
+			serials = append(serials, d.serial)
+		}
+
+		list = append(list, ringingInfo{
+			ID:       ringData.ID,
+			Client:   ringData.clientType,
+			CallerID: ringData.CallerID,
+			Devices:  serials,
+			Started:  ringData.started,
+		})
+	}
+
+	render.JSON(w, r, list)
+}
+
+func handleStopRinging(w http.ResponseWriter, r *http.Request) {
+	token, ok := authorize(w, r, "admin")
+	if !ok {
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, ringData := range ringing {
+		if ringData.ID == id {
+			for _, d := range ringData.devices {
+				if !token.allowsDevice(d) {
+					render.Status(r, http.StatusForbidden)
+					render.PlainText(w, r, "token can't use every device the call is ringing")
+					return
+				}
+			}
+
+			slog.Info(fmt.Sprintf("Token %s stopped ringing %s from client %s", token.name, id, ringData.clientType))
+			ringing.StopRinging(id)
+
+			if client, ok := clients[ringData.clientType]; ok {
+				client.Cancelled(ringData)
+			}
+
+			render.NoContent(w, r)
+			return
+		}
+	}
+
+	render.Status(r, http.StatusNotFound)
+	render.PlainText(w, r, "ring not found")
+}
+
+func handleTestRing(w http.ResponseWriter, r *http.Request) {
+	token, ok := authorize(w, r, "ring")
+	if !ok {
+		return
+	}
+
+	data := &testRingData{}
+	err := render.DecodeJSON(r.Body, data)
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.PlainText(w, r, err.Error())
+		return
+	}
+
+	if data.CallerID != nil {
+		_, err = data.CallerID.normalize()
+		if err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.PlainText(w, r, err.Error())
+			return
+		}
+	}
+
+	if data.Cadence != "" && !cadenceExists(data.Cadence) {
+		render.Status(r, http.StatusBadRequest)
+		render.PlainText(w, r, fmt.Sprintf("unknown ring cadence %s", data.Cadence))
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	d, ok := apiDevice(w, r, token)
+	if !ok {
+		return
+	}
+
+	if d.inUse {
+		render.Status(r, http.StatusConflict)
+		render.PlainText(w, r, "device is off-hook")
+		return
+	}
+
+	if !ringable(w, r, d) {
+		return
+	}
+
+	id := uuid.New().String()
+
+	slog.Info(fmt.Sprintf("[%s] Test ring %s from token %s", d.serial, id, token.name))
+	ringing.StartRinging(ringData{
+		ID:         id,
+		CallerID:   data.CallerID,
+		Cadence:    data.Cadence,
+		clientType: "api",
+		target:     d,
+	})
+
+	render.Status(r, http.StatusAccepted)
+	render.JSON(w, r, originateResult{State: "ringing", ID: id})
+}
+
+// handleOriginate places a call from a device. an idle handset that's off-hook calls straight away,
+// one that's on-hook is rung first and calls once picked up
+func handleOriginate(w http.ResponseWriter, r *http.Request) {
+	token, ok := authorize(w, r, "call")
+	if !ok {
+		return
+	}
+
+	data := originateData{}
+	err := render.DecodeJSON(r.Body, &data)
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.PlainText(w, r, err.Error())
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	request, err := data.resolve()
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.PlainText(w, r, err.Error())
+		return
+	}
+
+	d, ok := apiDevice(w, r, token)
+	if !ok {
+		return
+	}
+
+	if d.clientUsingPhone != "" || d.threeWay != nil || d.permanentSignal {
+		render.Status(r, http.StatusConflict)
+		render.PlainText(w, r, "device is busy")
+		return
+	}
+
+	if !d.inUse && !ringable(w, r, d) {
+		return
+	}
+
+	slog.Info(fmt.Sprintf("[%s] Originating a call to %s via dialer %s from token %s", d.serial, data.Number, data.Dialer, token.name))
+
+	if d.inUse {
+		d.audio.Stop()
+		d.dialTone = false
+		d.dialpad = ""
+		d.stopOffHookTimer()
+
+		d.dialer = request.dialer
+		d.call(request.client, request.number)
+
+		render.JSON(w, r, originateResult{State: "calling"})
+		return
+	}
+
+	id := uuid.New().String()
+	api.originating[id] = request
+
+	ringing.StartRinging(ringData{
+		ID: id,
+		CallerID: &calleridData{
+			Time:   time.Now(),
+			Number: data.Number,
+		},
+		clientType: "api",
+		target:     d,
+	})
+
+	render.Status(r, http.StatusAccepted)
+	render.JSON(w, r, originateResult{State: "ringing", ID: id})
+}
+
+// handleHangUp ends the call on the client side, leaving the handset as if the far end hung up
+func handleHangUp(w http.ResponseWriter, r *http.Request) {
+	token, ok := authorize(w, r, "call")
+	if !ok {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	d, ok := apiDevice(w, r, token)
+	if !ok {
+		return
+	}
+
+	clientType := d.clientUsingPhone
+	client, ok := clients[clientType]
+	if !ok {
+		render.Status(r, http.StatusConflict)
+		render.PlainText(w, r, "device is not in a call")
+		return
+	}
+
+	slog.Info(fmt.Sprintf("[%s] Hanging up client %s from token %s", d.serial, clientType, token.name))
+
+	connection := d.clientConnection
+	client.End(d, connection)
+	d.clientEnded(clientType, connection)
+
+	render.NoContent(w, r)
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
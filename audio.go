@@ -24,6 +24,7 @@ var dialingFrequencies = []float64{440, 480}
 var dialingOnOff = [2]int{sampleRate * 2, sampleRate * 4}
 var busyFrequencies = []float64{480, 620}
 var busyOnOff = [2]int{sampleRate / 2, sampleRate / 2}
+var stutterOnOff = [2]int{sampleRate / 10, sampleRate / 10}
 
 type audioDeviceId struct {
 	malgo malgo.DeviceID
@@ -90,10 +91,16 @@ func (d *audioDevice) Play(s audioSource) {
 }
 
 func (d *audioDevice) PlayAndWait(s audioSource) {
+	d.playAndWait(s)
+}
+
+// playAndWait plays a source until it's done or stopped, returning the source it interrupted
+func (d *audioDevice) playAndWait(s audioSource) audioSource {
 	ch := make(chan struct{})
 
 	d.mu.Lock()
 
+	previous := d.source
 	d.stop()
 	d.source = s
 	d.doneCallback = func() {
@@ -104,14 +111,28 @@ func (d *audioDevice) PlayAndWait(s audioSource) {
 	d.mu.Unlock()
 
 	<-ch
+
+	return previous
 }
 
-func (d *audioDevice) PlayCallerID(data calleridData) error {
+func (d *audioDevice) PlayCallerID(data calleridData, c deviceConfig, cal callerIDCalibration) error {
 	if data.Time.IsZero() {
 		data.Time = time.Now()
 	}
 
-	streamer, err := newCallerIdSource(data)
+	var streamer audioSource
+	var err error
+
+	switch c.CallerIDStandard {
+	case "", "bell202":
+		streamer, err = newCallerIdSource(data, c.CallerIDFormat, cal)
+	case "etsi-fsk":
+		streamer, err = newFSKCallerIDSource(data, c.CallerIDFormat, v23Modem, cal)
+	case "dtmf":
+		streamer, err = newDTMFCallerIDSource(data, cal)
+	default:
+		err = fmt.Errorf("invalid caller id standard: %s", c.CallerIDStandard)
+	}
 	if err != nil {
 		return err
 	}
@@ -121,6 +142,28 @@ func (d *audioDevice) PlayCallerID(data calleridData) error {
 	return nil
 }
 
+// PlayTypeIICallerID sends caller ID to an off-hook phone, then resumes what it interrupted unless something else started playing
+func (d *audioDevice) PlayTypeIICallerID(data calleridData, c deviceConfig, cal callerIDCalibration) error {
+	if data.Time.IsZero() {
+		data.Time = time.Now()
+	}
+
+	streamer, err := newTypeIICallerIDSource(data, c.CallerIDStandard, c.CallerIDFormat, cal)
+	if err != nil {
+		return err
+	}
+
+	previous := d.playAndWait(streamer)
+
+	d.mu.Lock()
+	if d.source == nil {
+		d.source = previous
+	}
+	d.mu.Unlock()
+
+	return nil
+}
+
 type audioSource interface {
 	Read(bytes []byte) (done bool)
 }
@@ -129,6 +172,7 @@ type toneSource struct {
 	frequencies []float64
 	offset      int
 	onOff       [2]int
+	onOffFor    int // samples to apply onOff for before the tone becomes steady, 0 for forever
 }
 
 func (s *toneSource) Read(bytes []byte) (done bool) {
@@ -141,7 +185,7 @@ func (s *toneSource) Read(bytes []byte) (done bool) {
 	for i := range samples {
 		point := float64(0)
 
-		if totalOnOff == 0 {
+		if totalOnOff == 0 || (s.onOffFor > 0 && i+s.offset >= s.onOffFor) {
 			for _, freq := range s.frequencies {
 				point += math.Sin(float64(i+s.offset)*(freq/sampleRate)*math.Pi*2) * 0.2
 			}
@@ -169,12 +213,25 @@ type callerIdSource struct {
 	stage         uint8
 	dir           string
 	offset        int
+	seizure       []byte
+	mark          []byte
 	payloadFile   *os.File
 	payloadStream *wav.Reader
 	ch            <-chan *wav.Reader
 }
 
-func newCallerIdSource(data calleridData) (*callerIdSource, error) {
+func newCallerIdSource(data calleridData, format string, cal callerIDCalibration) (*callerIdSource, error) {
+	payload, err := calleridDataToBytes(data, format)
+	if err != nil {
+		return nil, err
+	}
+
+	seizure := signalWriter{level: cal.Level}
+	seizure.Seizure(bell202Modem, cal.Seizure)
+
+	mark := signalWriter{level: cal.Level}
+	mark.Mark(bell202Modem, cal.Mark)
+
 	dir, err := os.MkdirTemp("", "callerid")
 	if err != nil {
 		return nil, err
@@ -183,8 +240,10 @@ func newCallerIdSource(data calleridData) (*callerIdSource, error) {
 	ch := make(chan *wav.Reader)
 
 	cidSource := &callerIdSource{
-		dir: dir,
-		ch:  ch,
+		dir:     dir,
+		seizure: seizure.Bytes(),
+		mark:    mark.Bytes(),
+		ch:      ch,
 	}
 
 	go func() {
@@ -197,7 +256,7 @@ func newCallerIdSource(data calleridData) (*callerIdSource, error) {
 			}
 		}
 
-		cmd := exec.Command(minimodem, "--tx", "1200", "-f", "output.wav", "-R", strconv.Itoa(sampleRate))
+		cmd := exec.Command(minimodem, "--tx", "1200", "-f", "output.wav", "-R", strconv.Itoa(sampleRate), "--volume", strconv.FormatFloat(cal.Level, 'f', -1, 64))
 		cmd.Dir = dir
 
 		if runtime.GOOS == "windows" && config.CygwinPath != "" {
@@ -220,7 +279,7 @@ func newCallerIdSource(data calleridData) (*callerIdSource, error) {
 			panic(err)
 		}
 
-		stdin.Write(calleridDataToBytes(data))
+		stdin.Write(payload)
 		stdin.Close()
 
 		err = cmd.Wait()
@@ -246,18 +305,18 @@ func (s *callerIdSource) Read(bytes []byte) (done bool) {
 	for filled < len(bytes) {
 		switch s.stage {
 		case 0:
-			n := copy(bytes[filled:], seizureData[s.offset:])
+			n := copy(bytes[filled:], s.seizure[s.offset:])
 			filled += n
 			s.offset += n
-			if len(seizureData[s.offset:]) == 0 {
+			if len(s.seizure[s.offset:]) == 0 {
 				s.offset = 0
 				s.stage += 1
 			}
 		case 1, 3:
-			n := copy(bytes[filled:], carrierData[s.offset:])
+			n := copy(bytes[filled:], s.mark[s.offset:])
 			filled += n
 			s.offset += n
-			if len(carrierData[s.offset:]) == 0 {
+			if len(s.mark[s.offset:]) == 0 {
 				s.offset = 0
 				s.stage += 1
 			}
@@ -266,7 +325,7 @@ func (s *callerIdSource) Read(bytes []byte) (done bool) {
 				s.payloadStream = <-s.ch
 			}
 
-			n, err := io.ReadFull(s.payloadStream, bytes)
+			n, err := io.ReadFull(s.payloadStream, bytes[filled:])
 
 			filled += n
 
@@ -325,27 +384,91 @@ func newAudioDevice(deviceID malgo.DeviceID) (*audioDevice, error) {
 	return s, nil
 }
 
-var audioContext *malgo.AllocatedContext
-var audioBackend malgo.Backend
+// newCaptureDevice starts capturing from a device's microphone, passing each buffer of samples to onData
+func newCaptureDevice(deviceID malgo.DeviceID, onData func(samples []byte)) (*malgo.Device, error) {
+	config := malgo.DefaultDeviceConfig(malgo.Capture)
+	config.Capture.DeviceID = deviceID.Pointer()
+	config.Capture.Channels = 1
+	config.Capture.Format = malgo.FormatS16
+	config.SampleRate = uint32(sampleRate)
+
+	callbacks := malgo.DeviceCallbacks{
+		Data: func(_, pInputSamples []byte, _ uint32) {
+			onData(pInputSamples)
+		},
+	}
 
-func loadWav(name string) []byte {
-	seizureFile, err := os.Open(name)
+	d, err := malgo.InitDevice(audioContext.Context, config, callbacks)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	defer seizureFile.Close()
+	err = d.Start()
+	if err != nil {
+		d.Uninit()
+		return nil, err
+	}
+
+	return d, nil
+}
 
-	data, err := io.ReadAll(wav.NewReader(seizureFile))
+// loadWav reads a wav file, which must be in the playback format
+func loadWav(name string) ([]byte, error) {
+	file, err := os.Open(name)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	defer file.Close()
+
+	reader := wav.NewReader(file)
+
+	format, err := reader.Format()
+	if err != nil {
+		return nil, err
+	}
+
+	if format.SampleRate != sampleRate || format.NumChannels != 1 || format.BitsPerSample != 16 {
+		return nil, fmt.Errorf("%s must be %dHz mono 16-bit", name, sampleRate)
 	}
 
-	return data
+	return io.ReadAll(reader)
 }
 
-var seizureData = loadWav("seizure.wav")
-var carrierData = loadWav("carrier.wav")
+// maxStreamBuffer is how much captured audio a streamSource holds before dropping the oldest, 200ms
+const maxStreamBuffer = sampleRate * 2 / 5
+
+// streamSource plays audio written to it from another device's capture
+type streamSource struct {
+	mu  deadlock.Mutex
+	buf []byte
+}
+
+func (s *streamSource) Write(samples []byte) {
+	s.mu.Lock()
+
+	s.buf = append(s.buf, samples...)
+	if len(s.buf) > maxStreamBuffer {
+		s.buf = s.buf[len(s.buf)-maxStreamBuffer:]
+	}
+
+	s.mu.Unlock()
+}
+
+func (s *streamSource) Read(bytes []byte) (done bool) {
+	s.mu.Lock()
+
+	n := copy(bytes, s.buf)
+	clear(bytes[n:])
+	s.buf = s.buf[n:]
+
+	s.mu.Unlock()
+
+	return false
+}
+
+var audioContext *malgo.AllocatedContext
+var audioBackend malgo.Backend
 
 func init() {
 	var err error
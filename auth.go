@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/go-chi/render"
+	"github.com/gorilla/websocket"
+)
+
+var tokenScopes = []string{"ring", "call", "admin", "debug"}
+
+type apiTokenConfig struct {
+	Secrets []string `yaml:"secrets"` // more than one while rotating to a new secret
+	Clients []string `yaml:"clients"` // client types the token can connect as, any if empty
+	Devices []string `yaml:"devices"` // device serials the token can ring and call from, any if empty
+	Scopes  []string `yaml:"scopes"`  // ring, call, admin, debug - admin allows everything
+}
+
+type apiToken struct {
+	name string
+	apiTokenConfig
+}
+
+func (t apiTokenConfig) validate() error {
+	if len(t.Secrets) == 0 {
+		return fmt.Errorf("no secrets")
+	}
+
+	for _, secret := range t.Secrets {
+		if secret == "" {
+			return fmt.Errorf("empty secret")
+		}
+	}
+
+	for _, scope := range t.Scopes {
+		if !slices.Contains(tokenScopes, scope) {
+			return fmt.Errorf("invalid scope: %s", scope)
+		}
+	}
+
+	return nil
+}
+
+func validateTokens(tokens map[string]apiTokenConfig) error {
+	for name, token := range tokens {
+		err := token.validate()
+		if err != nil {
+			return fmt.Errorf("token %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func (t *apiToken) hasScope(scope string) bool {
+	return slices.Contains(t.Scopes, scope) || slices.Contains(t.Scopes, "admin")
+}
+
+func (t *apiToken) allowsClient(clientType string) bool {
+	return len(t.Clients) == 0 || slices.Contains(t.Clients, clientType)
+}
+
+func (t *apiToken) allowsDevice(d *device) bool {
+	return len(t.Devices) == 0 || slices.Contains(t.Devices, d.serial)
+}
+
+func secretMatches(secret string, expected string) bool {
+	// hashed so the comparison takes the same time whatever the lengths
+	a := sha256.Sum256([]byte(secret))
+	b := sha256.Sum256([]byte(expected))
+
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
+
+// authenticate finds the token of a request, sent as a bearer token or in the secret query parameter for websockets.
+// the legacy shared secret is a token with every scope
+func authenticate(r *http.Request) (*apiToken, bool) {
+	secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	// browsers can't set headers on websockets, and the debug page is opened by url and passes the secret on
+	// to its websocket. other requests keep secrets out of urls and logs
+	if !ok && (websocket.IsWebSocketUpgrade(r) || r.URL.Path == "/debug") {
+		secret = r.URL.Query().Get("secret")
+	}
+
+	// without a secret or tokens configured, anyone can connect
+	if config.Secret == "" && len(config.Tokens) == 0 {
+		return &apiToken{
+			name:           "anonymous",
+			apiTokenConfig: apiTokenConfig{Scopes: []string{"admin"}},
+		}, true
+	}
+
+	if secret == "" {
+		return nil, false
+	}
+
+	var found *apiToken
+
+	// every secret is compared so the time taken doesn't reveal which matched
+	if config.Secret != "" && secretMatches(secret, config.Secret) {
+		found = &apiToken{
+			name:           "secret",
+			apiTokenConfig: apiTokenConfig{Scopes: []string{"admin"}},
+		}
+	}
+
+	for name, token := range config.Tokens {
+		for _, expected := range token.Secrets {
+			if secretMatches(secret, expected) && found == nil {
+				found = &apiToken{
+					name:           name,
+					apiTokenConfig: token,
+				}
+			}
+		}
+	}
+
+	return found, found != nil
+}
+
+// authorize checks the request's token has a scope, writing the error response if not. an empty scope only authenticates
+func authorize(w http.ResponseWriter, r *http.Request, scope string) (*apiToken, bool) {
+	token, ok := authenticate(r)
+	if !ok {
+		slog.Warn(fmt.Sprintf("[auth] Invalid token for %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr))
+		render.Status(r, http.StatusUnauthorized)
+		render.PlainText(w, r, "invalid token")
+		return nil, false
+	}
+
+	if scope != "" && !token.hasScope(scope) {
+		slog.Warn(fmt.Sprintf("[auth] Token %s denied %s %s from %s, missing scope %s", token.name, r.Method, r.URL.Path, r.RemoteAddr, scope))
+		render.Status(r, http.StatusForbidden)
+		render.PlainText(w, r, fmt.Sprintf("token is missing the %s scope", scope))
+		return nil, false
+	}
+
+	slog.Info(fmt.Sprintf("[auth] Token %s used for %s %s from %s", token.name, r.Method, r.URL.Path, r.RemoteAddr))
+
+	return token, true
+}
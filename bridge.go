@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/gen2brain/malgo"
+)
+
+// audioBridge connects the microphone of each device to the speaker of the other
+type audioBridge struct {
+	captures []*malgo.Device
+}
+
+func newAudioBridge(a *device, b *device) (*audioBridge, error) {
+	bridge := &audioBridge{}
+
+	toA := &streamSource{}
+	toB := &streamSource{}
+
+	captureA, err := newCaptureDevice(a.audioDeviceIds.Input.malgo, toB.Write)
+	if err != nil {
+		return nil, err
+	}
+
+	bridge.captures = append(bridge.captures, captureA)
+
+	captureB, err := newCaptureDevice(b.audioDeviceIds.Input.malgo, toA.Write)
+	if err != nil {
+		bridge.Close()
+		return nil, err
+	}
+
+	bridge.captures = append(bridge.captures, captureB)
+
+	a.audio.Play(toA)
+	b.audio.Play(toB)
+
+	return bridge, nil
+}
+
+func (b *audioBridge) Close() {
+	for _, capture := range b.captures {
+		capture.Uninit()
+	}
+
+	b.captures = nil
+}
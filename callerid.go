@@ -3,19 +3,150 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"net/http"
 	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/go-chi/render"
 )
 
+const maxCallerIDNumberLength = 20
+const maxCallerIDNameLength = 15
+const maxSDMFNumberLength = 10
+
+// calleridData fields are sent in MDMF in the order they're declared, by their parameter type in the id tag
 type calleridData struct {
-	Time             time.Time `json:"time" id:"1"`
-	Number           string    `json:"number" id:"2"`
-	NumberNotPresent string    `json:"numberNotPresent" id:"4"` // O | P
-	Name             string    `json:"name" id:"7"`
-	NameNotPresent   string    `name:"string" id:"8"` // O | P
+	Time              time.Time `json:"time" id:"01"`
+	Number            string    `json:"number" id:"02"`
+	CalledLineID      string    `json:"calledLineId" id:"03"`     // number the caller dialed
+	NumberNotPresent  string    `json:"numberNotPresent" id:"04"` // O | P
+	CallQualifier     string    `json:"callQualifier" id:"06"`    // L
+	Name              string    `json:"name" id:"07"`
+	NameNotPresent    string    `json:"nameNotPresent" id:"08"` // O | P
+	MessageWaiting    *bool     `json:"messageWaiting" id:"0B"` // visual message waiting indicator, false turns it off
+	CallType          uint8     `json:"callType" id:"11"`       // 1 = voice, 2 = ring-back-when-free, 0x81 = message waiting
+	FirstCalledLineID string    `json:"firstCalledLineId" id:"12"`
+	MessageCount      uint8     `json:"messageCount" id:"13"`      // messages waiting
+	ForwardedCallType uint8     `json:"forwardedCallType" id:"15"` // 1 = busy, 2 = no reply, 3 = unconditional, 4 = deflected after alerting, 5 = deflected immediately
+	CallingUserType   uint8     `json:"callingUserType" id:"16"`   // 1 = voice, 2 = text, 3 = vpn, 4 = mobile
+	RedirectingNumber string    `json:"redirectingNumber" id:"1A"`
+}
+
+func normalizeCallerIDNumber(field string, number string) (string, error) {
+	var b strings.Builder
+
+	for _, r := range number {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case strings.ContainsRune("+-(). ", r):
+			// formatting characters are dropped
+		default:
+			return "", fmt.Errorf("invalid character %q in %s", r, field)
+		}
+	}
+
+	number = b.String()
+	if len(number) > maxCallerIDNumberLength {
+		// keep the subscriber digits, the country code is the least useful part on a handset
+		number = number[len(number)-maxCallerIDNumberLength:]
+	}
+
+	return number, nil
+}
+
+func validateNotPresent(field string, value string) error {
+	if value != "" && value != "O" && value != "P" {
+		return fmt.Errorf("invalid %s: %s (expected O or P)", field, value)
+	}
+
+	return nil
+}
+
+// normalize validates caller ID data and truncates fields that are too long for the phone to display
+func (data calleridData) normalize() (calleridData, error) {
+	var err error
+
+	data.Number, err = normalizeCallerIDNumber("number", data.Number)
+	if err != nil {
+		return data, err
+	}
+
+	data.CalledLineID, err = normalizeCallerIDNumber("calledLineId", data.CalledLineID)
+	if err != nil {
+		return data, err
+	}
+
+	data.FirstCalledLineID, err = normalizeCallerIDNumber("firstCalledLineId", data.FirstCalledLineID)
+	if err != nil {
+		return data, err
+	}
+
+	data.RedirectingNumber, err = normalizeCallerIDNumber("redirectingNumber", data.RedirectingNumber)
+	if err != nil {
+		return data, err
+	}
+
+	err = validateNotPresent("numberNotPresent", data.NumberNotPresent)
+	if err != nil {
+		return data, err
+	}
+
+	err = validateNotPresent("nameNotPresent", data.NameNotPresent)
+	if err != nil {
+		return data, err
+	}
+
+	if data.CallQualifier != "" && data.CallQualifier != "L" {
+		return data, fmt.Errorf("invalid callQualifier: %s (expected L)", data.CallQualifier)
+	}
+
+	if name := []rune(data.Name); len(name) > maxCallerIDNameLength {
+		data.Name = string(name[:maxCallerIDNameLength])
+	}
+
+	return data, nil
+}
+
+func formatCallerIDTime(t time.Time) string {
+	t = t.Local()
+
+	return fmt.Sprintf("%02d%02d%02d%02d", int(t.Month()), t.Day(), t.Hour(), t.Minute())
 }
 
-func calleridDataToBytes(data calleridData) []byte {
+func calleridMessage(messageType byte, body []byte) []byte {
+	payload := append([]byte{messageType, byte(len(body))}, body...)
+
+	var checksum byte
+	for _, b := range payload {
+		checksum += b
+	}
+
+	return append(payload, -checksum)
+}
+
+// calleridDataToBytes encodes caller ID data in the given format (mdmf or sdmf, defaulting to mdmf)
+func calleridDataToBytes(data calleridData, format string) ([]byte, error) {
+	data, err := data.normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case "", "mdmf":
+		return calleridDataToMDMF(data), nil
+	case "sdmf":
+		return calleridDataToSDMF(data), nil
+	default:
+		return nil, fmt.Errorf("invalid caller id format: %s", format)
+	}
+}
+
+func calleridDataToMDMF(data calleridData) []byte {
 	var b bytes.Buffer
 
 	t := reflect.TypeOf(data)
@@ -33,52 +164,208 @@ func calleridDataToBytes(data calleridData) []byte {
 			continue
 		}
 
-		id := field.Tag.Get("id")[0] - 48
+		id, err := strconv.ParseUint(field.Tag.Get("id"), 16, 8)
+		if err != nil {
+			panic(err)
+		}
 
-		b.WriteByte(id)
+		b.WriteByte(byte(id))
 
 		var val string
 
-		if time, ok := value.Interface().(time.Time); ok {
-			time = time.Local()
+		switch value := value.Interface().(type) {
+		case time.Time:
+			val = formatCallerIDTime(value)
+		case uint8:
+			val = string([]byte{value})
+		case *bool:
+			val = "\x00"
+			if *value {
+				val = "\xFF"
+			}
+		default:
+			val = value.(string)
+		}
+
+		b.WriteByte(byte(len(val)))
+		b.WriteString(val)
+	}
+
+	return calleridMessage(0x80, b.Bytes())
+}
+
+// calleridDataToSDMF encodes the single data message format used by older phones, which only carries the time and number
+func calleridDataToSDMF(data calleridData) []byte {
+	var b bytes.Buffer
+
+	b.WriteString(formatCallerIDTime(data.Time))
+
+	if data.Number != "" {
+		number := data.Number
+		if len(number) > maxSDMFNumberLength {
+			number = number[len(number)-maxSDMFNumberLength:]
+		}
+
+		b.WriteString(number)
+	} else if data.NumberNotPresent != "" {
+		b.WriteString(data.NumberNotPresent)
+	} else {
+		b.WriteString("O")
+	}
+
+	return calleridMessage(0x04, b.Bytes())
+}
+
+// calleridDataToDTMF encodes the number as DTMF digits, as used in Denmark, the Netherlands and India
+func calleridDataToDTMF(data calleridData) (string, error) {
+	data, err := data.normalize()
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case data.Number != "":
+		return "A" + data.Number + "C", nil
+	case data.NumberNotPresent == "P":
+		return "B10C", nil
+	default:
+		return "B00C", nil
+	}
+}
+
+type callerIDResult struct {
+	Device string `json:"device"` // serial
+	Type   int    `json:"type"`   // 1 = on-hook, 2 = off-hook
+	Status string `json:"status"` // sending, sent, failed, or off-hook if the device was skipped
+	Error  string `json:"error,omitempty"`
+}
+
+// handleCallerID plays caller ID without ringing, on the devices given by serial or every device.
+// off-hook devices are skipped unless offHook=type2, and wait=true reports whether each device was sent it
+func handleCallerID(w http.ResponseWriter, r *http.Request) {
+	token, ok := authorize(w, r, "debug")
+	if !ok {
+		return
+	}
+
+	cidData := calleridData{}
+	err := render.DecodeJSON(r.Body, &cidData)
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.PlainText(w, r, err.Error())
+		return
+	}
+
+	_, err = cidData.normalize()
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.PlainText(w, r, err.Error())
+		return
+	}
 
-			month := fmt.Sprint(int(time.Month()))
-			if len(month) == 1 {
-				month = "0" + month
+	query := r.URL.Query()
+	serials := query["device"]
+	offHook := query.Get("offHook")
+	wait := query.Get("wait") == "true"
+
+	if offHook != "" && offHook != "refuse" && offHook != "type2" {
+		render.Status(r, http.StatusBadRequest)
+		render.PlainText(w, r, fmt.Sprintf("invalid offHook: %s (expected refuse or type2)", offHook))
+		return
+	}
+
+	mu.Lock()
+
+	var selected []*device
+
+	if len(serials) == 0 {
+		for _, d := range devices {
+			if token.allowsDevice(d) {
+				selected = append(selected, d)
+			}
+		}
+	} else {
+		for _, serial := range serials {
+			d := deviceBySerial(serial)
+			if d == nil {
+				mu.Unlock()
+				render.Status(r, http.StatusNotFound)
+				render.PlainText(w, r, fmt.Sprintf("device %s not found", serial))
+				return
 			}
 
-			day := fmt.Sprint(int(time.Day()))
-			if len(day) == 1 {
-				day = "0" + day
+			if !token.allowsDevice(d) {
+				mu.Unlock()
+				render.Status(r, http.StatusForbidden)
+				render.PlainText(w, r, fmt.Sprintf("token can't use device %s", serial))
+				return
 			}
 
-			hour := fmt.Sprint(int(time.Hour()))
-			if len(hour) == 1 {
-				hour = "0" + hour
+			if !slices.Contains(selected, d) {
+				selected = append(selected, d)
 			}
+		}
+	}
 
-			minute := fmt.Sprint(int(time.Minute()))
-			if len(minute) == 1 {
-				minute = "0" + minute
+	// asking to refuse off-hook devices fails the request rather than skipping them
+	if offHook == "refuse" {
+		for _, d := range selected {
+			if d.inUse {
+				mu.Unlock()
+				render.Status(r, http.StatusConflict)
+				render.PlainText(w, r, fmt.Sprintf("device %s is off-hook", d.serial))
+				return
 			}
+		}
+	}
 
-			val = fmt.Sprintf("%s%s%s%s", month, day, hour, minute)
-		} else {
-			val = value.Interface().(string)
+	results := make([]callerIDResult, len(selected))
+	var wg sync.WaitGroup
+
+	for i, d := range selected {
+		results[i] = callerIDResult{Device: d.serial, Type: 1, Status: "sending"}
+
+		if d.inUse {
+			if offHook != "type2" {
+				results[i].Status = "off-hook"
+				continue
+			}
+
+			results[i].Type = 2
 		}
 
-		b.WriteByte(byte(len(val)))
-		b.WriteString(val)
-	}
+		typeII := d.inUse
+		wg.Add(1)
 
-	finalBytes := b.Bytes()
+		go func() {
+			defer wg.Done()
 
-	payload := append([]byte{0x80, byte(len(finalBytes))}, finalBytes...)
+			var err error
+			if typeII {
+				err = d.playTypeIICallerID(cidData)
+			} else {
+				d.alertCallerID()
+				err = d.playCallerID(cidData)
+			}
 
-	var checksum byte
-	for _, b := range payload {
-		checksum += b
+			if wait {
+				results[i].Status = "sent"
+				if err != nil {
+					results[i].Status = "failed"
+					results[i].Error = err.Error()
+				}
+			}
+		}()
 	}
 
-	return append(payload, -checksum)
+	mu.Unlock()
+
+	if !wait {
+		render.Status(r, http.StatusAccepted)
+		render.JSON(w, r, results)
+		return
+	}
+
+	wg.Wait()
+	render.JSON(w, r, results)
 }
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"github.com/sasha-s/go-deadlock"
+)
+
+type callRecord struct {
+	ID          string     `json:"id"`
+	Device      string     `json:"device"`
+	Direction   string     `json:"direction"` // inbound, outbound
+	Client      string     `json:"client"`
+	Dialer      string     `json:"dialer,omitempty"`
+	Number      string     `json:"number,omitempty"`
+	Name        string     `json:"name,omitempty"`
+	Start       time.Time  `json:"start"`
+	Answer      *time.Time `json:"answer,omitempty"`
+	End         *time.Time `json:"end,omitempty"`
+	Disposition string     `json:"disposition"`      // answered, cancelled, missed, busy, rejected, unreachable, failed
+	Reason      string     `json:"reason,omitempty"` // why the call failed, as given by the client
+
+	reportsAnswer bool // the client says when the call is answered, so until then it can be cancelled
+}
+
+// maxCallQueryLimit is the most records /calls returns at once
+const maxCallQueryLimit = 500
+
+type callFilter struct {
+	Device      string
+	Direction   string
+	Client      string
+	Number      string
+	Disposition string
+	Since       time.Time
+	Until       time.Time
+}
+
+func (f callFilter) matches(r callRecord) bool {
+	return (f.Device == "" || r.Device == f.Device) &&
+		(f.Direction == "" || r.Direction == f.Direction) &&
+		(f.Client == "" || r.Client == f.Client) &&
+		(f.Number == "" || r.Number == f.Number) &&
+		(f.Disposition == "" || r.Disposition == f.Disposition) &&
+		(f.Since.IsZero() || !r.Start.Before(f.Since)) &&
+		(f.Until.IsZero() || r.Start.Before(f.Until))
+}
+
+// callLog is an append-only JSONL file of finished calls
+type callLog struct {
+	mu   deadlock.Mutex
+	path string
+	last map[[2]string]callRecord // keyed by device and direction
+}
+
+var calls = callLog{
+	last: map[[2]string]callRecord{},
+}
+
+func (l *callLog) Append(r callRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.last[[2]string{r.Device, r.Direction}] = r
+
+	if l.path == "" {
+		return
+	}
+
+	err := l.append(r)
+	if err != nil {
+		slog.Error(fmt.Sprintf("[%s] Unable to write call log: %s", r.Device, err))
+	}
+}
+
+func (l *callLog) append(r callRecord) error {
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	return json.NewEncoder(f).Encode(r)
+}
+
+// Query returns the matching records newest first, along with the total number of matches.
+// only the newest offset+limit matches are kept while the file is read
+func (l *callLog) Query(filter callFilter, offset int, limit int) ([]callRecord, int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	records := []callRecord{}
+	total := 0
+
+	f, err := os.Open(l.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return records, 0, nil
+		}
+
+		return nil, 0, err
+	}
+
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, 0, err
+		}
+
+		if len(bytes.TrimSpace(data)) > 0 {
+			var r callRecord
+
+			// a corrupt line, like one cut short by a crash, shouldn't hide the rest of the log
+			unmarshalErr := json.Unmarshal(data, &r)
+			if unmarshalErr != nil {
+				slog.Error(fmt.Sprintf("Skipping line %d of call log: %s", line, unmarshalErr))
+			} else if filter.matches(r) {
+				total++
+
+				records = append(records, r)
+				if len(records) > offset+limit {
+					records = records[1:]
+				}
+			}
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	slices.Reverse(records)
+	records = records[min(offset, len(records)):]
+
+	return records, total, nil
+}
+
+// Last returns the most recent call of a device in the given direction
+func (l *callLog) Last(serial string, direction string) (callRecord, bool) {
+	l.mu.Lock()
+	r, ok := l.last[[2]string{serial, direction}]
+	l.mu.Unlock()
+
+	if ok {
+		return r, true
+	}
+
+	records, _, err := l.Query(callFilter{Device: serial, Direction: direction}, 0, 1)
+	if err != nil || len(records) == 0 {
+		return callRecord{}, false
+	}
+
+	return records[0], true
+}
+
+func newCallRecord(d *device, direction string, client string, number string) *callRecord {
+	return &callRecord{
+		ID:        uuid.New().String(),
+		Device:    d.serial,
+		Direction: direction,
+		Client:    client,
+		Number:    number,
+		Start:     time.Now(),
+	}
+}
+
+// logCall finishes a call record and writes it to the call log
+func logCall(r *callRecord, disposition string) {
+	r.Disposition = disposition
+
+	if r.End == nil {
+		end := time.Now()
+		r.End = &end
+	}
+
+	calls.Append(*r)
+}
+
+// logMissedCall writes a missed record for every device a call rang
+func logMissedCall(data ringData) {
+	// test and originate rings from the REST API aren't calls
+	if data.clientType == "api" {
+		return
+	}
+
+	for _, d := range data.rang {
+		r := newCallRecord(d, "inbound", data.clientType, data.Number())
+		r.Start = data.started
+
+		if data.CallerID != nil {
+			r.Name = data.CallerID.Name
+		}
+
+		logCall(r, "missed")
+	}
+}
+
+// disposition is how a call that was hung up ended: cancelled if it was never answered.
+// calls through clients that don't say when they're answered are taken as answered once placed
+func (r *callRecord) disposition() string {
+	if r.Answer == nil && r.reportsAnswer {
+		return "cancelled"
+	}
+
+	return "answered"
+}
+
+// endCall writes the device's active call to the call log with how it ended
+func (d *device) endCall() {
+	if d.activeCall == nil {
+		return
+	}
+
+	d.finishCall(d.activeCall.disposition())
+}
+
+// finishCall writes the device's active call to the call log with how it ended
+func (d *device) finishCall(disposition string) {
+	if d.activeCall == nil {
+		return
+	}
+
+	logCall(d.activeCall, disposition)
+	d.activeCall = nil
+	d.lastCall = time.Now()
+}
+
+func parseCallFilter(r *http.Request) (callFilter, error) {
+	query := r.URL.Query()
+
+	filter := callFilter{
+		Device:      query.Get("device"),
+		Direction:   query.Get("direction"),
+		Client:      query.Get("client"),
+		Number:      query.Get("number"),
+		Disposition: query.Get("disposition"),
+	}
+
+	var err error
+
+	if since := query.Get("since"); since != "" {
+		filter.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			return filter, err
+		}
+	}
+
+	if until := query.Get("until"); until != "" {
+		filter.Until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			return filter, err
+		}
+	}
+
+	return filter, nil
+}
+
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("invalid %s: %s", name, value)
+	}
+
+	return i, nil
+}
+
+func handleCalls(w http.ResponseWriter, r *http.Request) {
+	_, ok := authorize(w, r, "admin")
+	if !ok {
+		return
+	}
+
+	filter, err := parseCallFilter(r)
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.PlainText(w, r, err.Error())
+		return
+	}
+
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.PlainText(w, r, err.Error())
+		return
+	}
+
+	limit, err := queryInt(r, "limit", 50)
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.PlainText(w, r, err.Error())
+		return
+	}
+
+	limit = min(limit, maxCallQueryLimit)
+
+	records, total, err := calls.Query(filter, offset, limit)
+	if err != nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.PlainText(w, r, err.Error())
+		return
+	}
+
+	render.JSON(w, r, map[string]any{
+		"total": total,
+		"calls": records,
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+// doNotDisturb reports whether the device shouldn't ring, either set from the handset/API or by schedule
+func (d *device) doNotDisturb() bool {
+	if d.dnd != nil {
+		return *d.dnd
+	}
+
+	now := time.Now()
+
+	for _, schedule := range d.config().DNDSchedule {
+		if schedule.active(now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setDoNotDisturb overrides the schedule, nil returns to following it
+func (d *device) setDoNotDisturb(dnd *bool) {
+	d.dnd = dnd
+
+	enabled := d.doNotDisturb()
+	slog.Info(fmt.Sprintf("[%s] Do not disturb: %t", d.serial, enabled))
+	publish("dnd", d, dndEvent{Enabled: enabled})
+}
+
+type dndData struct {
+	Enabled *bool `json:"enabled"`
+}
+
+func handleDND(w http.ResponseWriter, r *http.Request) {
+	_, ok := authorize(w, r, "admin")
+	if !ok {
+		return
+	}
+
+	data := &dndData{}
+	err := render.DecodeJSON(r.Body, data)
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.PlainText(w, r, err.Error())
+		return
+	}
+
+	serial := chi.URLParam(r, "serial")
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, d := range devices {
+		if d.serial == serial {
+			d.setDoNotDisturb(data.Enabled)
+
+			enabled := d.doNotDisturb()
+			render.JSON(w, r, dndData{Enabled: &enabled})
+			return
+		}
+	}
+
+	render.Status(r, http.StatusNotFound)
+	render.PlainText(w, r, "device not found")
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+)
+
+// eventTypes are the events clients can subscribe to
+var eventTypes = []string{"device", "hook", "dialpad", "ringing", "dnd", "error"}
+
+// eventData is pushed to subscribed clients in an "event" message
+type eventData struct {
+	Event  string `json:"event"`
+	Device string `json:"device"` // serial
+	Data   any    `json:"data"`
+}
+
+type deviceEvent struct {
+	State     string `json:"state"` // connected, disconnected
+	Extension string `json:"extension,omitempty"`
+}
+
+type hookEvent struct {
+	OffHook bool `json:"offHook"`
+	Flash   bool `json:"flash,omitempty"`
+}
+
+type dialpadEvent struct {
+	Dialer string `json:"dialer"`
+	Digits string `json:"digits"` // everything dialed so far
+}
+
+type ringingEvent struct {
+	Ringing bool   `json:"ringing"`
+	ID      string `json:"id,omitempty"`
+	Client  string `json:"client,omitempty"`
+}
+
+type dndEvent struct {
+	Enabled bool `json:"enabled"`
+}
+
+type errorEvent struct {
+	Message string `json:"message"`
+}
+
+type subscriptionData struct {
+	Events []string `json:"events"`
+}
+
+// publish sends an event to every connection subscribed to it, mu must be held
+func publish(event string, d *device, data any) {
+	for _, client := range clients {
+		ws, ok := client.(*wsAggregatorClient)
+		if !ok {
+			continue
+		}
+
+		for _, conn := range ws.connections {
+			if slices.Contains(conn.subscriptions, event) && conn.canSee(event, d) {
+				conn.sendEvent(event, d, data)
+			}
+		}
+	}
+}
+
+// canSee reports whether the connection's token lets it see an event from a device.
+// dialpad events can carry codes typed into phone menus, so they need the call scope
+func (c *wsConnection) canSee(event string, d *device) bool {
+	return c.token.allowsDevice(d) && (event != "dialpad" || c.token.hasScope("call"))
+}
+
+func (c *wsConnection) sendEvent(event string, d *device, data any) {
+	c.send("event", eventData{
+		Event:  event,
+		Device: d.serial,
+		Data:   data,
+	})
+}
+
+// subscribe adds events and sends the current state of every device the token can use for them
+func (c *wsConnection) subscribe(data subscriptionData) error {
+	for _, event := range data.Events {
+		if !slices.Contains(eventTypes, event) {
+			return protocolError("invalid-payload", "unknown event %s", event)
+		}
+
+		if event == "dialpad" && !c.token.hasScope("call") {
+			return protocolError("forbidden", "token %s is missing the call scope for dialpad events", c.token.name)
+		}
+	}
+
+	for _, event := range data.Events {
+		if slices.Contains(c.subscriptions, event) {
+			continue
+		}
+
+		c.subscriptions = append(c.subscriptions, event)
+
+		for _, d := range devices {
+			if !c.canSee(event, d) {
+				continue
+			}
+
+			if state := d.eventState(event); state != nil {
+				c.sendEvent(event, d, state)
+			}
+		}
+	}
+
+	return nil
+}
+
+// unsubscribe removes events, or all of them if none are given
+func (c *wsConnection) unsubscribe(data subscriptionData) {
+	if len(data.Events) == 0 {
+		c.subscriptions = nil
+		return
+	}
+
+	c.subscriptions = slices.DeleteFunc(c.subscriptions, func(event string) bool {
+		return slices.Contains(data.Events, event)
+	})
+}
+
+// eventState is the current state of a device for an event, nil if the event has no state
+func (d *device) eventState(event string) any {
+	switch event {
+	case "device":
+		return deviceEvent{
+			State:     "connected",
+			Extension: d.config().Extension,
+		}
+	case "hook":
+		return hookEvent{OffHook: d.inUse}
+	case "dialpad":
+		if d.dialer == "" {
+			return nil
+		}
+
+		return dialpadEvent{Dialer: d.dialer, Digits: d.dialpad}
+	case "ringing":
+		r, i := ringing.Ringing(d)
+		if i == -1 || d.inUse {
+			return ringingEvent{Ringing: false}
+		}
+
+		return ringingEvent{Ringing: true, ID: r.ID, Client: r.clientType}
+	case "dnd":
+		return dndEvent{Enabled: d.doNotDisturb()}
+	}
+
+	return nil
+}
+
+// reportError logs a device error and publishes it to subscribed clients, mu must be held
+func (d *device) reportError(message string) {
+	slog.Error(fmt.Sprintf("[%s] %s", d.serial, message))
+	publish("error", d, errorEvent{Message: message})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// runFeatureCode runs a star code dialed from the handset, as configured in the dialer's feature-codes
+func (d *device) runFeatureCode(feature string) {
+	d.dialpad = ""
+
+	switch feature {
+	case "redial":
+		last, ok := calls.Last(d.serial, "outbound")
+		if !ok {
+			slog.Info(fmt.Sprintf("[%s] Redial failed because there is no previous call", d.serial))
+			break
+		}
+
+		slog.Info(fmt.Sprintf("[%s] Redialing %s", d.serial, last.Number))
+		d.dialer = last.Dialer
+		d.call(last.Client, last.Number)
+		return
+	case "return-call":
+		last, ok := calls.Last(d.serial, "inbound")
+		if !ok || last.Number == "" {
+			slog.Info(fmt.Sprintf("[%s] Return call failed because the last caller's number is unknown", d.serial))
+			break
+		}
+
+		slog.Info(fmt.Sprintf("[%s] Returning call from %s", d.serial, last.Number))
+		d.dialer = ""
+		d.call(last.Client, last.Number)
+		return
+	case "dnd-on", "dnd-off", "dnd-toggle":
+		dnd := feature == "dnd-on" || (feature == "dnd-toggle" && !d.doNotDisturb())
+		d.setDoNotDisturb(&dnd)
+
+		d.dialer = ""
+		d.audio.Play(newConfirmationSource())
+		return
+	case "hold":
+		if d.threeWay == nil {
+			slog.Info(fmt.Sprintf("[%s] Hold failed because there is no call to hold", d.serial))
+			break
+		}
+
+		d.holdFirstCall()
+		d.audio.Play(newConfirmationSource())
+		return
+	default:
+		slog.Info(fmt.Sprintf("[%s] Unknown feature %s", d.serial, feature))
+	}
+
+	d.dialer = ""
+	d.audio.Play(&toneSource{
+		frequencies: busyFrequencies,
+		onOff:       busyOnOff,
+	})
+}
@@ -6,10 +6,12 @@ import (
 	"log/slog"
 	"regexp"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/nyaruka/phonenumbers"
 )
 
@@ -21,63 +23,105 @@ var stopRingingSilverReport = []byte{0x0, 0x4, 0x3d, 0x20, 0x1, 0x0, 0x0, 0x0, 0
 var resetSilverReport = []byte{0x0, 0x4, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}
 var reduceRingerInsensitySilverReport = []byte{0x0, 0x4, 0x2f, 0x40, 0x1, 0x14, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}
 
-func (d *device) startRinging() {
-	slog.Debug(fmt.Sprintf("[%s] Started ringing", d.serial))
+// bellcore distinctive ringing patterns, as alternating on/off durations in ms
+var defaultRingCadences = map[string][]int{
+	"standard":     {2000, 4000},
+	"bellcore-dr1": {2000, 4000},
+	"bellcore-dr2": {800, 400, 800, 4000},
+	"bellcore-dr3": {400, 200, 400, 200, 800, 4000},
+	"bellcore-dr4": {300, 200, 1000, 200, 300, 4000},
+}
 
+func (d *device) setRinger(on bool) {
 	if d.silver {
-		ctx, cancel := context.WithCancel(context.Background())
+		report := stopRingingSilverReport
+		if on {
+			report = startRingingSilverReport
+		}
 
-		d.stopSilverRinger = cancel
+		select {
+		case d.sendHidSyncedFeatureReport <- report:
+		case <-d.hidClosed:
+		}
+	} else {
+		if on {
+			d.hid.SendFeatureReport(startRingingReport)
+		} else {
+			d.hid.SendFeatureReport(stopRingingReport)
+		}
+	}
+}
 
-		go func() {
-		loop:
-			for {
-				d.sendHidSyncedFeatureReport <- startRingingSilverReport
+func (d *device) startRinging(cadence []int) {
+	slog.Debug(fmt.Sprintf("[%s] Started ringing (Cadence=%v)", d.serial, cadence))
 
-				select {
-				case <-time.After(2 * time.Second):
-					d.sendHidSyncedFeatureReport <- stopRingingSilverReport
-				case <-ctx.Done():
-					d.sendHidSyncedFeatureReport <- stopRingingSilverReport
-					break loop
-				}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	d.stopRinger = cancel
+
+	go func() {
+		for {
+			for i, duration := range cadence {
+				on := i%2 == 0
+
+				d.setRinger(on)
 
 				select {
-				case <-time.After(4 * time.Second):
+				case <-time.After(time.Duration(duration) * time.Millisecond):
 					// NOOP
 				case <-ctx.Done():
-					break loop
+					if on {
+						d.setRinger(false)
+					}
+					return
 				}
 			}
-		}()
-	} else {
-		d.hid.SendFeatureReport(startRingingReport)
-	}
+		}
+	}()
 }
 
 func (d *device) stopRinging() {
 	slog.Debug(fmt.Sprintf("[%s] Stopped ringing", d.serial))
 
+	if d.stopCallerID != nil || d.stopRinger != nil {
+		publish("ringing", d, ringingEvent{Ringing: false})
+	}
+
 	if d.stopCallerID != nil {
 		d.stopCallerID()
 		d.stopCallerID = nil
 	}
 
-	if !d.silver {
-		d.hid.SendFeatureReport(stopRingingReport)
-	} else if d.stopSilverRinger != nil {
-		d.stopSilverRinger()
-		d.stopSilverRinger = nil
+	if d.stopRinger != nil {
+		d.stopRinger()
+		d.stopRinger = nil
 	}
 }
 
+// ringPulse rings the phone once for the given duration, used as an alert before caller ID
+func (d *device) ringPulse(duration time.Duration) {
+	d.setRinger(true)
+	time.Sleep(duration)
+	d.setRinger(false)
+}
+
 func (d *device) call(clientType string, number string) {
 	previousDialer := d.dialer
 	d.dialer = ""
 
+	record := newCallRecord(d, "outbound", clientType, number)
+	record.Dialer = previousDialer
+
 	if client, ok := clients[clientType]; ok {
-		if !client.InUse() {
+		if !client.InUse(d) {
 			d.clientUsingPhone = clientType
+			d.clientConnection = uuid.Nil
+
+			// switching dialers isn't a call. the record is set first so the client can say it reports answers
+			if clientType != "dialer" {
+				d.activeCall = record
+			}
+
 			client.Call(d, callData{
 				Number: number,
 				Device: d.audioDeviceIds,
@@ -85,6 +129,7 @@ func (d *device) call(clientType string, number string) {
 			slog.Info(fmt.Sprintf("[%s] Calling %s on client %s via dialer %s", d.serial, number, clientType, previousDialer))
 		} else {
 			slog.Info(fmt.Sprintf("[%s] Calling %s on client %s via dialer %s failed because the client is busy", d.serial, number, clientType, previousDialer))
+			logCall(record, "busy")
 			d.audio.Play(&toneSource{
 				frequencies: busyFrequencies,
 				onOff:       busyOnOff,
@@ -92,6 +137,7 @@ func (d *device) call(clientType string, number string) {
 		}
 	} else {
 		slog.Info(fmt.Sprintf("[%s] Calling %s on client %s via dialer %s failed because the client does not exist", d.serial, number, clientType, previousDialer))
+		logCall(record, "failed")
 		d.audio.Play(&toneSource{
 			frequencies: busyFrequencies,
 			onOff:       busyOnOff,
@@ -103,18 +149,38 @@ func (d *device) onHidChange(offHook bool, currentNumber byte) {
 	mu.Lock()
 
 	if offHook {
-		if !d.inUse {
+		if d.pendingHangUp != nil {
+			// back off-hook before the hang up went through
+			d.pendingHangUp.Stop()
+			d.pendingHangUp = nil
+
+			slog.Debug(fmt.Sprintf("[%s] Hook flash", d.serial))
+
+			d.flash()
+		} else if !d.inUse {
 			d.inUse = true
 
 			slog.Debug(fmt.Sprintf("[%s] Off-hook", d.serial))
+			publish("hook", d, hookEvent{OffHook: true})
 
 			d.stopRinging()
 
 			ringData, ok := ringing.Answer(d)
+			answered := false
 
 			if ok {
 				if client, ok := clients[ringData.clientType]; ok {
+					answered = true
+					d.activeCall = newCallRecord(d, "inbound", ringData.clientType, ringData.Number())
+					d.activeCall.Start = ringData.started
+					answeredAt := time.Now()
+					d.activeCall.Answer = &answeredAt
+					if ringData.CallerID != nil {
+						d.activeCall.Name = ringData.CallerID.Name
+					}
+
 					d.clientUsingPhone = ringData.clientType
+					d.clientConnection = ringData.clientId
 					d.dialer = ""
 					client.Answer(d, callAnswerData{
 						ID:       ringData.ID,
@@ -125,35 +191,27 @@ func (d *device) onHidChange(offHook bool, currentNumber byte) {
 				}
 			}
 
-			if d.clientUsingPhone == "" {
-				d.dialer = d.config().Dialer
-
-				d.audio.Play(&toneSource{
-					frequencies: config.Dialers[d.dialer].DialTone,
-				})
-
-				d.dialTone = true
+			// the client decides what the handset hears once it has answered
+			if !answered {
+				d.startDialTone()
 			}
 		}
-	} else if d.inUse {
-		d.inUse = false
-		d.dialpad = ""
-		d.dialer = ""
-		d.dialTone = false
-
-		d.audio.Stop()
-
-		slog.Debug(fmt.Sprintf("[%s] On-hook", d.serial))
-
-		if d.clientUsingPhone != "" {
-			clients[d.clientUsingPhone].End(d)
-
-			d.clientUsingPhone = ""
-		}
+	} else if d.inUse && d.pendingHangUp == nil {
+		if d.clientUsingPhone != "" || d.threeWay != nil {
+			// wait to see if this is a hook flash
+			var timer *time.Timer
+			timer = time.AfterFunc(d.flashTime(), func() {
+				mu.Lock()
+				if d.pendingHangUp == timer {
+					d.pendingHangUp = nil
+					d.hangUp()
+				}
+				mu.Unlock()
+			})
 
-		ringData, i := ringing.Ringing(d)
-		if i > -1 {
-			d.ring(ringData.CallerID)
+			d.pendingHangUp = timer
+		} else {
+			d.hangUp()
 		}
 	}
 
@@ -175,6 +233,9 @@ func (d *device) onHidChange(offHook bool, currentNumber byte) {
 		}
 
 		d.dialpad += currentNumberStr
+		d.armOffHookTimer()
+
+		publish("dialpad", d, dialpadEvent{Dialer: d.dialer, Digits: d.dialpad})
 
 		slog.Debug(fmt.Sprintf("[%s] Dialpad: %s", d.serial, currentNumberStr))
 
@@ -193,39 +254,107 @@ func (d *device) onHidChange(offHook bool, currentNumber byte) {
 
 		dialer := config.Dialers[d.dialer]
 
-		if dialer.Client != "" {
-			number := d.dialpad
-			dial := false
-
-			if dialer.ClientNumberFormat == "phone" {
-				number, err := phonenumbers.Parse(d.dialpad, dialer.ClientNumberRegion)
-				if err == nil && phonenumbers.IsValidNumber(number) {
-					dial = true
+		if feature, ok := dialer.FeatureCodes[d.dialpad]; ok {
+			d.runFeatureCode(feature)
+		} else {
+			if dialer.Client != "" {
+				number := d.dialpad
+				dial := false
+
+				if dialer.ClientNumberFormat == "phone" {
+					number, err := phonenumbers.Parse(d.dialpad, dialer.ClientNumberRegion)
+					if err == nil && phonenumbers.IsValidNumber(number) {
+						dial = true
+					}
+				} else {
+					matches := regexp.MustCompile(dialer.ClientNumberFormat).FindStringSubmatch(d.dialpad)
+
+					if len(matches) == 2 {
+						number = matches[1]
+						dial = true
+					} else if len(matches) == 1 {
+						dial = true
+					}
 				}
-			} else {
-				matches := regexp.MustCompile(dialer.ClientNumberFormat).FindStringSubmatch(d.dialpad)
-
-				if len(matches) == 2 {
-					number = matches[1]
-					dial = true
-				} else if len(matches) == 1 {
-					dial = true
+
+				if dial {
+					d.call(dialer.Client, number)
 				}
 			}
 
-			if dial {
-				d.call(dialer.Client, number)
+			if dialer.Map != nil {
+				if data, ok := dialer.Map[d.dialpad]; ok {
+					d.call(data[0], data[1])
+				}
 			}
 		}
+	}
 
-		if dialer.Map != nil {
-			if data, ok := dialer.Map[d.dialpad]; ok {
-				d.call(data[0], data[1])
-			}
+	mu.Unlock()
+}
+
+// startDialTone plays the device's dialer's dial tone, ready for a number
+func (d *device) startDialTone() {
+	d.dialer = d.config().Dialer
+
+	d.audio.Play(&toneSource{
+		frequencies: config.Dialers[d.dialer].DialTone,
+	})
+
+	d.dialTone = true
+	d.armOffHookTimer()
+}
+
+func (d *device) hangUp() {
+	d.inUse = false
+	d.onHold = false
+	d.permanentSignal = false
+	d.stopOffHookTimer()
+	d.dialpad = ""
+	d.dialer = ""
+	d.dialTone = false
+
+	d.audio.Stop()
+
+	slog.Debug(fmt.Sprintf("[%s] On-hook", d.serial))
+	publish("hook", d, hookEvent{OffHook: false})
+
+	var recall *pendingTransfer
+
+	// hanging up while dialing a second party transfers the first call to them
+	if d.threeWay != nil && !d.threeWay.conferenced {
+		recall = transfers.start(d)
+	}
+
+	if d.threeWay != nil {
+		if client, ok := clients[d.threeWay.client]; ok {
+			client.End(d, d.threeWay.connection)
+		}
+
+		if d.threeWay.call != nil {
+			logCall(d.threeWay.call, d.threeWay.call.disposition())
 		}
+
+		d.threeWay = nil
 	}
 
-	mu.Unlock()
+	if d.clientUsingPhone != "" {
+		clients[d.clientUsingPhone].End(d, d.clientConnection)
+
+		d.clientUsingPhone = ""
+		d.clientConnection = uuid.Nil
+	}
+
+	d.endCall()
+
+	ringData, i := ringing.Ringing(d)
+	if i > -1 {
+		d.ring(ringData)
+	}
+
+	if recall != nil {
+		transfers.recall(recall)
+	}
 }
 
 func readFeatureReport(featureReport []byte) (bool, byte) {
@@ -264,6 +393,8 @@ func (d *device) hidInit() {
 	var featureReport [65]byte
 	var sendHidSyncedFeatureReport chan []byte
 
+	d.hidClosed = make(chan struct{})
+
 	_, err := d.hid.GetFeatureReport(featureReport[:])
 	if err != nil {
 		// older magicjack devices need to be requested with a 32 byte buffer
@@ -305,7 +436,8 @@ func (d *device) hidInit() {
 							continue
 						}
 
-						panic(err)
+						d.disconnect(err)
+						return
 					}
 
 					offHook, number := readSilverFeatureReport(featureReport[:])
@@ -326,7 +458,8 @@ func (d *device) hidInit() {
 			for {
 				_, err := d.hid.Read(bytes[:])
 				if err != nil {
-					panic(err)
+					d.disconnect(err)
+					return
 				}
 
 				d.onHidChange(bytes[1] == 128, bytes[0])
@@ -334,3 +467,36 @@ func (d *device) hidInit() {
 		}
 	}()
 }
+
+// disconnect removes a device whose hid connection failed, ending anything it was doing
+func (d *device) disconnect(err error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	close(d.hidClosed)
+
+	devices = slices.DeleteFunc(devices, func(other *device) bool {
+		return other == d
+	})
+
+	for i := range ringing {
+		ringing[i].hunt = slices.DeleteFunc(ringing[i].hunt, func(other *device) bool {
+			return other == d
+		})
+	}
+
+	for _, r := range slices.Clone(ringing) {
+		ringing.timeout(r.key, d)
+	}
+
+	d.stopRinging()
+
+	if d.inUse {
+		d.hangUp()
+	}
+
+	d.reportError(fmt.Sprintf("Disconnected: %s", err))
+	publish("device", d, deviceEvent{State: "disconnected"})
+
+	d.hid.Close()
+}
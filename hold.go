@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// musicOnHold is played to the other party of a bridged call while it's on hold, silence if empty
+var musicOnHold []byte
+
+func newMusicOnHoldSource() audioSource {
+	if len(musicOnHold) == 0 {
+		return nil
+	}
+
+	return &pcmSource{data: musicOnHold, loop: true}
+}
+
+// hold puts the current call on hold, a flash resumes it
+func (d *device) hold() {
+	client, ok := clients[d.clientUsingPhone]
+	if !ok || d.onHold {
+		return
+	}
+
+	d.onHold = true
+	d.audio.Stop()
+	client.Hold(d, d.clientConnection)
+
+	slog.Info(fmt.Sprintf("[%s] Holding client %s", d.serial, d.clientUsingPhone))
+}
+
+func (d *device) resume() {
+	d.onHold = false
+
+	if client, ok := clients[d.clientUsingPhone]; ok {
+		client.Resume(d, d.clientConnection)
+	}
+
+	slog.Info(fmt.Sprintf("[%s] Resuming client %s", d.serial, d.clientUsingPhone))
+}
+
+// holdFirstCall keeps the first call of a three-way call on hold and drops the dial tone for the second party
+func (d *device) holdFirstCall() {
+	if d.threeWay == nil {
+		return
+	}
+
+	d.dialer = ""
+	d.dialpad = ""
+	d.dialTone = false
+	d.audio.Stop()
+
+	d.clientUsingPhone = d.threeWay.client
+	d.clientConnection = d.threeWay.connection
+	d.activeCall = d.threeWay.call
+	d.threeWay = nil
+	d.onHold = true
+
+	slog.Info(fmt.Sprintf("[%s] Holding client %s", d.serial, d.clientUsingPhone))
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type intercomCall struct {
+	id     string
+	caller *device
+	callee *device
+	bridge *audioBridge
+	held   bool
+}
+
+// intercomClient calls between local devices by extension, bridging their audio
+type intercomClient struct {
+	calls []*intercomCall
+}
+
+var intercom = &intercomClient{}
+
+func deviceByExtension(extension string) *device {
+	for _, d := range devices {
+		if d.config().Extension == extension {
+			return d
+		}
+	}
+
+	return nil
+}
+
+// callFrom returns the call a device is placing
+func (c *intercomClient) callFrom(d *device) *intercomCall {
+	for _, call := range c.calls {
+		if call.caller == d {
+			return call
+		}
+	}
+
+	return nil
+}
+
+func (c *intercomClient) call(id string) *intercomCall {
+	for _, call := range c.calls {
+		if call.id == id {
+			return call
+		}
+	}
+
+	return nil
+}
+
+func (c *intercomClient) remove(call *intercomCall) {
+	c.calls = slices.DeleteFunc(c.calls, func(other *intercomCall) bool {
+		return other == call
+	})
+
+	if call.bridge != nil {
+		call.bridge.Close()
+	}
+}
+
+func (c *intercomClient) Call(d *device, data callData, _ string) {
+	target := deviceByExtension(data.Number)
+
+	if target == nil || target == d || target.inUse || target.doNotDisturb() {
+		slog.Info(fmt.Sprintf("[%s] Intercom call to %s failed because the extension is unavailable", d.serial, data.Number))
+		d.audio.Play(&toneSource{
+			frequencies: busyFrequencies,
+			onOff:       busyOnOff,
+		})
+		return
+	}
+
+	call := &intercomCall{
+		id:     uuid.New().String(),
+		caller: d,
+		callee: target,
+	}
+	c.calls = append(c.calls, call)
+
+	// the call isn't answered until the callee picks up
+	if d.activeCall != nil {
+		d.activeCall.reportsAnswer = true
+	}
+
+	d.audio.Play(&toneSource{
+		frequencies: dialingFrequencies,
+		onOff:       dialingOnOff,
+	})
+
+	ringing.StartRinging(ringData{
+		ID: call.id,
+		CallerID: &calleridData{
+			Number: d.config().Extension,
+			Name:   "Intercom",
+		},
+		clientType: "intercom",
+		target:     target,
+	})
+}
+
+func (c *intercomClient) End(d *device, _ uuid.UUID) {
+	for _, call := range c.calls {
+		if call.caller != d && call.callee != d {
+			continue
+		}
+
+		c.remove(call)
+
+		other := call.callee
+		if d == call.callee {
+			other = call.caller
+		}
+
+		if call.bridge != nil || call.held {
+			// the other party is still off-hook
+			other.audio.Play(&toneSource{
+				frequencies: busyFrequencies,
+				onOff:       busyOnOff,
+			})
+		} else {
+			ringing.StopRinging(call.id)
+		}
+
+		break
+	}
+}
+
+func (c *intercomClient) Answer(d *device, data callAnswerData) {
+	call := c.call(data.ID)
+	if call == nil {
+		return
+	}
+
+	call.callee = d
+
+	bridge, err := newAudioBridge(call.caller, call.callee)
+	if err != nil {
+		d.reportError(fmt.Sprintf("Unable to bridge intercom call with %s: %s", call.caller.serial, err))
+		c.remove(call)
+		call.caller.audio.Play(&toneSource{
+			frequencies: busyFrequencies,
+			onOff:       busyOnOff,
+		})
+		return
+	}
+
+	call.bridge = bridge
+
+	if record := call.caller.activeCall; record != nil && record.Answer == nil {
+		answered := time.Now()
+		record.Answer = &answered
+	}
+}
+
+// Missed is called when the callee doesn't answer in time
+func (c *intercomClient) Missed(data ringData) {
+	c.unavailable(data)
+}
+
+func (c *intercomClient) DoNotDisturb(data ringData) {
+	c.unavailable(data)
+}
+
+func (c *intercomClient) Cancelled(data ringData) {
+	c.unavailable(data)
+}
+
+func (c *intercomClient) unavailable(data ringData) {
+	call := c.call(data.ID)
+	if call == nil {
+		return
+	}
+
+	c.remove(call)
+	call.caller.audio.Play(&toneSource{
+		frequencies: busyFrequencies,
+		onOff:       busyOnOff,
+	})
+}
+
+func (c *intercomClient) Conference(_ *device, _ conferenceData) {
+}
+
+// Transfer moves one end of an intercom call to another device
+func (c *intercomClient) Transfer(from *device, to *device, _ transferData) bool {
+	if to == nil {
+		return false
+	}
+
+	for _, call := range c.calls {
+		if call.caller != from && call.callee != from {
+			continue
+		}
+
+		if call.caller == from {
+			call.caller = to
+		} else {
+			call.callee = to
+		}
+
+		if call.bridge != nil {
+			call.bridge.Close()
+			call.bridge = nil
+
+			bridge, err := newAudioBridge(call.caller, call.callee)
+			if err != nil {
+				call.caller.reportError(fmt.Sprintf("Unable to bridge intercom call with %s: %s", call.callee.serial, err))
+				c.remove(call)
+				return false
+			}
+
+			call.bridge = bridge
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// Hold plays music on hold to the other party instead of the held device's microphone
+func (c *intercomClient) Hold(d *device, _ uuid.UUID) {
+	for _, call := range c.calls {
+		if call.bridge == nil || (call.caller != d && call.callee != d) {
+			continue
+		}
+
+		call.bridge.Close()
+		call.bridge = nil
+		call.held = true
+
+		other := call.callee
+		if d == call.callee {
+			other = call.caller
+		}
+
+		if source := newMusicOnHoldSource(); source != nil {
+			other.audio.Play(source)
+		} else {
+			other.audio.Stop()
+		}
+
+		break
+	}
+}
+
+func (c *intercomClient) Resume(d *device, _ uuid.UUID) {
+	for _, call := range c.calls {
+		if !call.held || (call.caller != d && call.callee != d) {
+			continue
+		}
+
+		call.held = false
+
+		bridge, err := newAudioBridge(call.caller, call.callee)
+		if err != nil {
+			call.caller.reportError(fmt.Sprintf("Unable to bridge intercom call with %s: %s", call.callee.serial, err))
+			c.End(d, uuid.Nil)
+			break
+		}
+
+		call.bridge = bridge
+		break
+	}
+}
+
+func (c *intercomClient) InUse(_ *device) bool {
+	return false
+}
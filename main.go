@@ -13,6 +13,7 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/cors"
 	"github.com/go-chi/render"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/sasha-s/go-deadlock"
 	"github.com/sstallion/go-hid"
@@ -23,17 +24,27 @@ const vendorId = 1766
 const productId = 49664
 const sampleRate = 16000
 
-type ringListItem [2]string
+type ringListItem [3]string // client, number, cadence
 
 func (r *ringListItem) UnmarshalYAML(unmarshal func(any) error) error {
-	err := unmarshal((*[2]string)(r))
+	var items []string
+
+	err := unmarshal(&items)
 	if err != nil {
 		err := unmarshal(&r[0])
 		if err != nil {
 			return err
 		}
+
+		return nil
+	}
+
+	if len(items) > len(r) {
+		return fmt.Errorf("invalid ring list item: %v", items)
 	}
 
+	copy(r[:], items)
+
 	return nil
 }
 
@@ -43,20 +54,113 @@ type dialerConfig struct {
 	ClientNumberRegion string               `yaml:"client-number-region"` // if format = phone
 	Map                map[string][2]string `yaml:"map"`                  // if type = map
 	DialTone           []float64            `yaml:"dial-tone"`
+	FeatureCodes       map[string]string    `yaml:"feature-codes"` // code -> redial, return-call, dnd-on, dnd-off, dnd-toggle
+}
+
+type callerIDCalibration struct {
+	Delay   int     `yaml:"delay"`   // ms to wait after the first ring starts, if caller-id = after-first-ring
+	Seizure int     `yaml:"seizure"` // channel seizure length in bits
+	Mark    int     `yaml:"mark"`    // mark length in bits
+	Level   float64 `yaml:"level"`   // output level, 0-1
+}
+
+// defaultCallerIDCalibrations are keyed by model
+var defaultCallerIDCalibrations = map[string]callerIDCalibration{
+	"default": {
+		Delay:   2250,
+		Seizure: 300,
+		Mark:    180,
+		Level:   1,
+	},
+	// the output distorts when it's too loud (see the README), so the silver starts a little lower
+	"silver": {
+		Delay:   2250,
+		Seizure: 300,
+		Mark:    180,
+		Level:   0.8,
+	},
+}
+
+type callerIDCalibrations map[string]callerIDCalibration
+
+type plainCallerIDCalibration callerIDCalibration
+
+func (c *callerIDCalibrations) UnmarshalYAML(value *yaml.Node) error {
+	var models map[string]yaml.Node
+	err := value.Decode(&models)
+	if err != nil {
+		return err
+	}
+
+	*c = callerIDCalibrations{}
+
+	for model, node := range models {
+		// fields that aren't set keep the model's default, unknown models are rejected by validate
+		cal := defaultCallerIDCalibrations[model]
+
+		err := node.Decode((*plainCallerIDCalibration)(&cal))
+		if err != nil {
+			return err
+		}
+
+		(*c)[model] = cal
+	}
+
+	return nil
+}
+
+func (c callerIDCalibrations) validate() error {
+	for model, cal := range c {
+		if _, ok := defaultCallerIDCalibrations[model]; !ok {
+			return fmt.Errorf("invalid caller-id-calibration model: %s (expected silver or default)", model)
+		}
+
+		if cal.Level <= 0 || cal.Level > 1 {
+			return fmt.Errorf("invalid caller-id-calibration level for %s: %g (expected above 0, up to 1)", model, cal.Level)
+		}
+
+		if cal.Delay < 0 || cal.Seizure < 0 || cal.Mark < 0 {
+			return fmt.Errorf("invalid caller-id-calibration for %s: delay, seizure and mark can't be negative", model)
+		}
+	}
+
+	return nil
 }
 
 type deviceConfig struct {
-	Dialer       string         `yaml:"dialer"`
-	CallerID     string         `yaml:"caller-id"` // off, before-first-ring, after-first-ring
-	RingListType string         `yaml:"ring-list-type"`
-	RingList     []ringListItem `yaml:"ring-list"`
+	Dialer              string               `yaml:"dialer"`
+	Extension           string               `yaml:"extension"`             // dialed with the intercom client to ring this device
+	FlashTime           int                  `yaml:"flash-time"`            // ms, going on-hook for less than this during a call is a hook flash
+	FlashAction         string               `yaml:"flash-action"`          // three-way, hold
+	OffHookTimeout      int                  `yaml:"off-hook-timeout"`      // seconds off-hook without dialing before reorder and the howler, 0 to disable
+	CallerID            string               `yaml:"caller-id"`             // off, before-first-ring, after-first-ring
+	CallerIDFormat      string               `yaml:"caller-id-format"`      // mdmf, sdmf
+	CallerIDStandard    string               `yaml:"caller-id-standard"`    // bell202, etsi-fsk, dtmf
+	CallerIDAlerting    string               `yaml:"caller-id-alerting"`    // none, line-reversal, ring-pulse (before-first-ring only)
+	CallerIDCalibration callerIDCalibrations `yaml:"caller-id-calibration"` // keyed by model: silver, default
+	RingRules           []ringRule           `yaml:"ring-rules"`
+	RingDefault         string               `yaml:"ring-default"`   // allow, deny - used when no ring rule matches
+	RingListType        string               `yaml:"ring-list-type"` // deprecated, converted into ring rules
+	RingList            []ringListItem       `yaml:"ring-list"`
+	ClientCadences      map[string]string    `yaml:"client-cadences"` // client type -> ring cadence
+	RingTimeout         int                  `yaml:"ring-timeout"`    // seconds, 0 rings until the client stops
+	DNDSchedule         []timeWindow         `yaml:"dnd-schedule"`
 }
 
 type configData struct {
-	Secret     string                  `yaml:"secret"`
-	CygwinPath string                  `yaml:"cygwin-path"` // path of cygwin if running on windows
-	Dialers    map[string]dialerConfig `yaml:"dialers"`
-	Devices    map[string]deviceConfig `yaml:"devices"`
+	Secret        string                     `yaml:"secret"` // shared secret with every scope, prefer tokens
+	Tokens        map[string]apiTokenConfig  `yaml:"tokens"`
+	Server        serverConfig               `yaml:"server"`
+	CygwinPath    string                     `yaml:"cygwin-path"`     // path of cygwin if running on windows
+	RingCadences  map[string][]int           `yaml:"ring-cadences"`   // alternating on/off durations in ms
+	CallLog       string                     `yaml:"call-log"`        // path of the call history file, disabled if empty
+	MusicOnHold   string                     `yaml:"music-on-hold"`   // wav played to intercom calls on hold, 16kHz mono 16-bit
+	OffHookPrompt string                     `yaml:"off-hook-prompt"` // "please hang up" wav played after reorder when left off-hook, 16kHz mono 16-bit
+	Announcements map[string]string          `yaml:"announcements"`   // busy, rejected, unreachable or error -> wav played when a call ends that way, 16kHz mono 16-bit
+	RingGroups    map[string]ringGroupConfig `yaml:"ring-groups"`
+	Routing       map[string]routingConfig   `yaml:"routing"` // client type -> which connection calls are placed through
+	Dialers       map[string]dialerConfig    `yaml:"dialers"`
+	Devices       map[string]deviceConfig    `yaml:"devices"`
 }
 
 type callData struct {
@@ -72,15 +176,22 @@ type callAnswerData struct {
 
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
-		return true
+		return originAllowed(r, r.Header.Get("Origin"))
 	},
 }
 
 type client interface {
 	Call(d *device, data callData, dialer string)
-	End(d *device)
+	End(d *device, connection uuid.UUID) // connection picks the call for clients with several, uuid.Nil for the rest
 	Answer(d *device, data callAnswerData)
-	InUse() bool
+	Missed(data ringData)
+	DoNotDisturb(data ringData)
+	Cancelled(data ringData) // the ring was stopped through the REST API
+	Conference(d *device, data conferenceData)
+	Transfer(from *device, to *device, data transferData) bool // reports whether the client could take the transfer
+	Hold(d *device, connection uuid.UUID)
+	Resume(d *device, connection uuid.UUID)
+	InUse(d *device) bool // reports whether the client has nothing free to place a call from the device
 }
 
 type dialerClient struct {
@@ -88,6 +199,7 @@ type dialerClient struct {
 
 func (c dialerClient) Call(d *device, data callData, dialer string) {
 	d.clientUsingPhone = ""
+	d.clientConnection = uuid.Nil
 
 	newDialer, ok := config.Dialers[data.Number]
 	if !ok {
@@ -107,17 +219,39 @@ func (c dialerClient) Call(d *device, data callData, dialer string) {
 	d.dialer = data.Number
 }
 
-func (c dialerClient) End(_ *device) {
+func (c dialerClient) End(_ *device, _ uuid.UUID) {
 }
 
 func (c dialerClient) Answer(_ *device, data callAnswerData) {
 }
 
+func (c dialerClient) Missed(_ ringData) {
+}
+
+func (c dialerClient) DoNotDisturb(_ ringData) {
+}
+
+func (c dialerClient) Cancelled(_ ringData) {
+}
+
+func (c dialerClient) Conference(_ *device, _ conferenceData) {
+}
+
+func (c dialerClient) Transfer(_ *device, _ *device, _ transferData) bool {
+	return false
+}
+
+func (c dialerClient) Hold(_ *device, _ uuid.UUID) {
+}
+
+func (c dialerClient) Resume(_ *device, _ uuid.UUID) {
+}
+
 func (c dialerClient) Ringing(_ *device) []ringData {
 	return nil
 }
 
-func (c dialerClient) InUse() bool {
+func (c dialerClient) InUse(_ *device) bool {
 	return false
 }
 
@@ -127,15 +261,25 @@ type device struct {
 	inUse                      bool
 	dialTone                   bool
 	ringing                    bool
+	dnd                        *bool // overrides the dnd schedule if set
 	clientUsingPhone           string
+	clientConnection           uuid.UUID // connection of the client using the phone, for clients with several
+	activeCall                 *callRecord
+	lastCall                   time.Time // when the last call ended, for least-recently-used ring groups
+	threeWay                   *threeWayCall
+	onHold                     bool
+	offHookTimer               *time.Timer
+	permanentSignal            bool        // left off-hook too long, ignoring the dialpad until hung up
+	pendingHangUp              *time.Timer // set while waiting to see if going on-hook is a hook flash
 	dialer                     string
 	dialpad                    string
 	hid                        *hid.Device
 	audio                      *audioDevice
 	audioDeviceIds             audioDeviceIds
 	stopCallerID               context.CancelFunc
-	stopSilverRinger           context.CancelFunc
+	stopRinger                 context.CancelFunc
 	sendHidSyncedFeatureReport chan []byte
+	hidClosed                  chan struct{} // closed when the hid connection fails
 }
 
 var devices []*device
@@ -151,63 +295,154 @@ func (d *device) config() deviceConfig {
 	return config.Devices["default"]
 }
 
-func (d *device) shouldRing(client string, number string) bool {
-	c := d.config()
+func (d *device) callerIDCalibration() callerIDCalibration {
+	model := "default"
+	if d.silver {
+		model = "silver"
+	}
 
-	switch c.RingListType {
-	case "whitelist":
-		for _, item := range c.RingList {
-			if item[0] == client && (item[1] == "" || item[1] == number) {
-				return true
-			}
+	if cal, ok := d.config().CallerIDCalibration[model]; ok {
+		return cal
+	}
+
+	return defaultCallerIDCalibrations[model]
+}
+
+// alertCallerID sends the alerting signal that some standards expect before caller ID sent prior to ringing
+func (d *device) alertCallerID() {
+	switch d.config().CallerIDAlerting {
+	case "line-reversal":
+		// the adapter can't reverse the line polarity, so only the dual tone alerting signal that follows it is sent
+		d.audio.PlayAndWait(newDTASSource(d.callerIDCalibration().Level))
+	case "ring-pulse":
+		d.ringPulse(250 * time.Millisecond)
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+func (d *device) playCallerID(data calleridData) error {
+	err := d.audio.PlayCallerID(data, d.config(), d.callerIDCalibration())
+	if err != nil {
+		mu.Lock()
+		d.reportError(fmt.Sprintf("Unable to play caller ID: %s", err))
+		mu.Unlock()
+	}
+
+	return err
+}
+
+// playTypeIICallerID sends caller ID to an off-hook phone, which goes back to what it was hearing afterwards
+func (d *device) playTypeIICallerID(data calleridData) error {
+	err := d.audio.PlayTypeIICallerID(data, d.config(), d.callerIDCalibration())
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err != nil {
+		d.reportError(fmt.Sprintf("Unable to play type II caller ID: %s", err))
+		return err
+	}
+
+	return nil
+}
+
+// cadenceExists reports whether a ring cadence is configured or built in
+func cadenceExists(name string) bool {
+	if cadence, ok := config.RingCadences[name]; ok && len(cadence) > 0 {
+		return true
+	}
+
+	_, ok := defaultRingCadences[name]
+	return ok
+}
+
+func validateRingCadences(cadences map[string][]int) error {
+	for name, cadence := range cadences {
+		if len(cadence) == 0 || len(cadence)%2 != 0 {
+			return fmt.Errorf("ring cadence %s needs alternating on and off durations", name)
 		}
 
-		return false
-	case "blacklist":
-		for _, item := range c.RingList {
-			if item[0] == client && (item[1] == "" || item[1] == number) {
-				return false
+		for _, duration := range cadence {
+			if duration <= 0 {
+				return fmt.Errorf("ring cadence %s has a duration that isn't positive", name)
 			}
 		}
+	}
 
-		return true
-	default:
-		panic(fmt.Sprintf("invalid ring list type: %s", c.RingListType))
+	return nil
+}
+
+// ringCadence picks the cadence requested by the client, then the matching ring rule, then the client type
+func (d *device) ringCadence(r ringData) []int {
+	name := r.Cadence
+
+	if name == "" {
+		if rule, ok := d.ringRule(r); ok {
+			name = rule.Cadence
+		}
+	}
+
+	if name == "" {
+		name = d.config().ClientCadences[r.clientType]
+	}
+
+	if cadence, ok := config.RingCadences[name]; ok && len(cadence) > 0 {
+		return cadence
+	}
+
+	if cadence, ok := defaultRingCadences[name]; ok {
+		return cadence
 	}
+
+	return defaultRingCadences["standard"]
 }
 
-func (d *device) ring(cidData *calleridData) {
-	if cidData != nil {
-		var ctx context.Context
-		ctx, d.stopCallerID = context.WithCancel(context.Background())
-		config := d.config()
+func (d *device) ring(r ringData) {
+	cidData := r.CallerID
+	cadence := d.ringCadence(r)
+	config := d.config()
 
-		if config.CallerID == "before-first-ring" {
-			go func() {
-				d.audio.PlayCallerID(*cidData)
-				d.startRinging()
-			}()
-		} else {
-			if config.CallerID == "after-first-ring" {
-				go func() {
-					select {
-					case <-time.After(2250 * time.Millisecond):
-						mu.Lock()
-						d.stopCallerID = nil
-						inUse := d.inUse
-						mu.Unlock()
-
-						if !inUse {
-							d.audio.PlayCallerID(*cidData)
-						}
-					case <-ctx.Done():
-						// Cancelled
-					}
-				}()
+	publish("ringing", d, ringingEvent{Ringing: true, ID: r.ID, Client: r.clientType})
+
+	if cidData == nil || (config.CallerID != "before-first-ring" && config.CallerID != "after-first-ring") {
+		d.startRinging(cadence)
+		return
+	}
+
+	var ctx context.Context
+	ctx, d.stopCallerID = context.WithCancel(context.Background())
+
+	if config.CallerID == "before-first-ring" {
+		go func() {
+			d.alertCallerID()
+			d.playCallerID(*cidData)
+
+			mu.Lock()
+			// the phone may have been answered or the call cancelled while caller id was playing
+			if ctx.Err() == nil {
+				d.stopCallerID = nil
+				d.startRinging(cadence)
+			}
+			mu.Unlock()
+		}()
+	} else {
+		go func() {
+			select {
+			case <-time.After(time.Duration(d.callerIDCalibration().Delay) * time.Millisecond):
+				mu.Lock()
+				d.stopCallerID = nil
+				inUse := d.inUse
+				mu.Unlock()
+
+				if !inUse {
+					d.playCallerID(*cidData)
+				}
+			case <-ctx.Done():
+				// Cancelled
 			}
+		}()
 
-			d.startRinging()
-		}
+		d.startRinging(cadence)
 	}
 }
 
@@ -217,6 +452,9 @@ func init() {
 	}
 
 	clients["dialer"] = dialerClient{}
+	clients["intercom"] = intercom
+	clients["transfer"] = transfers
+	clients["api"] = api
 }
 
 func main() {
@@ -242,6 +480,61 @@ func main() {
 		panic(err)
 	}
 
+	err = validateRingCadences(config.RingCadences)
+	if err != nil {
+		panic(fmt.Sprintf("invalid config: %s", err))
+	}
+
+	for serial, deviceConfig := range config.Devices {
+		err := deviceConfig.validate()
+		if err != nil {
+			panic(fmt.Sprintf("invalid config for device %s: %s", serial, err))
+		}
+
+		config.Devices[serial] = deviceConfig
+	}
+
+	err = validateRingGroups(config.RingGroups)
+	if err != nil {
+		panic(fmt.Sprintf("invalid config: %s", err))
+	}
+
+	err = validateRouting(config.Routing)
+	if err != nil {
+		panic(fmt.Sprintf("invalid config: %s", err))
+	}
+
+	err = validateTokens(config.Tokens)
+	if err != nil {
+		panic(fmt.Sprintf("invalid config: %s", err))
+	}
+
+	err = config.Server.validate()
+	if err != nil {
+		panic(fmt.Sprintf("invalid server config: %s", err))
+	}
+
+	calls.path = config.CallLog
+
+	if config.MusicOnHold != "" {
+		musicOnHold, err = loadWav(config.MusicOnHold)
+		if err != nil {
+			panic(fmt.Sprintf("invalid music-on-hold: %s", err))
+		}
+	}
+
+	if config.OffHookPrompt != "" {
+		offHookPrompt, err = loadWav(config.OffHookPrompt)
+		if err != nil {
+			panic(fmt.Sprintf("invalid off-hook-prompt: %s", err))
+		}
+	}
+
+	err = loadAnnouncements(config.Announcements)
+	if err != nil {
+		panic(fmt.Sprintf("invalid config: %s", err))
+	}
+
 	err = hid.Enumerate(vendorId, productId, func(info *hid.DeviceInfo) error {
 		h, err := hid.Open(vendorId, productId, info.SerialNbr)
 		if err != nil {
@@ -289,20 +582,19 @@ func main() {
 
 	r := chi.NewRouter()
 	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"*"},
+		AllowOriginFunc:  originAllowed,
 		AllowedMethods:   []string{"GET", "POST", "DELETE"},
-		AllowedHeaders:   []string{"Content-Type"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization"},
 		AllowCredentials: false,
 		MaxAge:           300,
 	}))
 
 	r.Get("/debug", func(w http.ResponseWriter, r *http.Request) {
-		secret := r.URL.Query().Get("secret")
-		if secret != config.Secret {
-			render.Status(r, http.StatusUnauthorized)
-			render.PlainText(w, r, "invalid secret")
+		_, ok := authorize(w, r, "debug")
+		if !ok {
 			return
 		}
+
 		file, err := os.Open("debug.html")
 		if err != nil {
 			render.Status(r, http.StatusInternalServerError)
@@ -320,30 +612,26 @@ func main() {
 		file.Close()
 	})
 
-	r.Post("/callerid", func(w http.ResponseWriter, r *http.Request) {
-		secret := r.URL.Query().Get("secret")
-		if secret != config.Secret {
-			render.Status(r, http.StatusUnauthorized)
-			render.PlainText(w, r, "invalid secret")
-			return
-		}
+	r.Post("/callerid", handleCallerID)
 
-		cidData := &calleridData{}
-		err := render.DecodeJSON(r.Body, cidData)
-		if err != nil {
-			render.Status(r, http.StatusBadRequest)
-			render.PlainText(w, r, err.Error())
-			return
-		}
+	r.Get("/calls", handleCalls)
 
-		for _, d := range devices {
-			go d.audio.PlayCallerID(*cidData)
-		}
+	r.Get("/devices", handleDevices)
+	r.Post("/devices/{serial}/dnd", handleDND)
+	r.Post("/devices/{serial}/ring", handleTestRing)
+	r.Post("/devices/{serial}/call", handleOriginate)
+	r.Post("/devices/{serial}/hangup", handleHangUp)
 
-		render.NoContent(w, r)
-	})
+	r.Get("/ringing", handleRinging)
+	r.Delete("/ringing/{id}", handleStopRinging)
+
+	r.Get("/openapi.json", handleOpenAPI)
 
 	r.HandleFunc("/ws", handleWebSocketConnection)
+	r.Get("/ws/schema", handleProtocolSchema)
 
-	http.ListenAndServe("127.0.0.1:5840", r)
+	err = serve(r)
+	if err != nil {
+		panic(err)
+	}
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+var reorderOnOff = [2]int{sampleRate / 4, sampleRate / 4}
+var howlerFrequencies = []float64{1400, 2060, 2450, 2600}
+var howlerOnOff = [2]int{sampleRate / 10, sampleRate / 10}
+
+const reorderDuration = 15 * time.Second
+const howlerDuration = 40 * time.Second
+
+// offHookPrompt is the recorded "please hang up" announcement, skipped if empty
+var offHookPrompt []byte
+
+type sequenceStage struct {
+	source audioSource
+	length int // bytes to play the source for, 0 until it's done
+}
+
+// sequenceSource plays sources one after another
+type sequenceSource struct {
+	stages []sequenceStage
+	offset int
+}
+
+func (s *sequenceSource) Read(bytes []byte) (done bool) {
+	filled := 0
+
+	for filled < len(bytes) {
+		if len(s.stages) == 0 {
+			clear(bytes[filled:])
+			return true
+		}
+
+		stage := s.stages[0]
+
+		end := len(bytes)
+		if stage.length > 0 {
+			end = min(end, filled+stage.length-s.offset)
+		}
+
+		stageDone := stage.source.Read(bytes[filled:end])
+		s.offset += end - filled
+		filled = end
+
+		if stageDone || (stage.length > 0 && s.offset >= stage.length) {
+			s.stages = s.stages[1:]
+			s.offset = 0
+		}
+	}
+
+	return false
+}
+
+func durationBytes(duration time.Duration) int {
+	return int(duration.Seconds()*sampleRate) * 2
+}
+
+// newOffHookSource plays reorder, the hang up prompt, then the howler before going silent
+func newOffHookSource() *sequenceSource {
+	s := &sequenceSource{}
+
+	s.stages = append(s.stages, sequenceStage{
+		source: &toneSource{
+			frequencies: busyFrequencies,
+			onOff:       reorderOnOff,
+		},
+		length: durationBytes(reorderDuration),
+	})
+
+	if len(offHookPrompt) > 0 {
+		s.stages = append(s.stages, sequenceStage{
+			source: &pcmSource{data: offHookPrompt},
+		})
+	}
+
+	s.stages = append(s.stages, sequenceStage{
+		source: &toneSource{
+			frequencies: howlerFrequencies,
+			onOff:       howlerOnOff,
+		},
+		length: durationBytes(howlerDuration),
+	})
+
+	return s
+}
+
+// armOffHookTimer restarts the time the handset can be left off-hook without dialing
+func (d *device) armOffHookTimer() {
+	d.stopOffHookTimer()
+
+	timeout := d.config().OffHookTimeout
+	if timeout <= 0 || !d.inUse {
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Duration(timeout)*time.Second, func() {
+		mu.Lock()
+		if d.offHookTimer == timer {
+			d.offHookTimer = nil
+			d.offHookTimeout()
+		}
+		mu.Unlock()
+	})
+
+	d.offHookTimer = timer
+}
+
+func (d *device) stopOffHookTimer() {
+	if d.offHookTimer != nil {
+		d.offHookTimer.Stop()
+		d.offHookTimer = nil
+	}
+}
+
+// offHookTimeout gives up on the handset dialing and leaves it in the permanent signal state until hung up
+func (d *device) offHookTimeout() {
+	if !d.inUse || d.clientUsingPhone != "" || d.threeWay != nil || d.permanentSignal {
+		return
+	}
+
+	slog.Info(fmt.Sprintf("[%s] Off-hook without dialing, permanent signal", d.serial))
+
+	d.permanentSignal = true
+	d.dialer = ""
+	d.dialpad = ""
+	d.dialTone = false
+
+	d.audio.Play(newOffHookSource())
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var progressStates = []string{"ringing", "answered", "busy", "rejected", "unreachable", "error"}
+
+// progressDispositions are the call log dispositions of the states that end a call
+var progressDispositions = map[string]string{
+	"busy":        "busy",
+	"rejected":    "rejected",
+	"unreachable": "unreachable",
+	"error":       "failed",
+}
+
+// announcements are the recordings played for a call ending in a progress state instead of its tone
+var announcements = map[string][]byte{}
+
+// progressData is sent by a client as an outbound call progresses
+type progressData struct {
+	State  string `json:"state"`            // ringing, answered, busy, rejected, unreachable, error
+	Reason string `json:"reason,omitempty"` // why the call failed
+}
+
+func loadAnnouncements(files map[string]string) error {
+	for state, file := range files {
+		if _, ok := progressDispositions[state]; !ok {
+			return fmt.Errorf("invalid announcement state: %s", state)
+		}
+
+		data, err := loadWav(file)
+		if err != nil {
+			return fmt.Errorf("announcement %s: %w", state, err)
+		}
+
+		announcements[state] = data
+	}
+
+	return nil
+}
+
+// newProgressSource plays what the handset hears when a call ends in a progress state:
+// the announcement if there is one, busy tone for busy and rejected calls, otherwise reorder.
+// unreachable numbers get the special information tone first
+func newProgressSource(state string) audioSource {
+	announcement := announcements[state]
+
+	if announcement == nil && (state == "busy" || state == "rejected") {
+		return &toneSource{
+			frequencies: busyFrequencies,
+			onOff:       busyOnOff,
+		}
+	}
+
+	s := &sequenceSource{}
+
+	if state == "unreachable" {
+		s.stages = append(s.stages, sequenceStage{source: newSITSource()})
+	}
+
+	if announcement != nil {
+		s.stages = append(s.stages, sequenceStage{source: &pcmSource{data: announcement}})
+	}
+
+	s.stages = append(s.stages, sequenceStage{
+		source: &toneSource{
+			frequencies: busyFrequencies,
+			onOff:       reorderOnOff,
+		},
+	})
+
+	return s
+}
+
+// progress updates the handset and call record of an outbound call from a client, mu must be held
+func (d *device) progress(clientType string, connection uuid.UUID, data progressData) error {
+	if !slices.Contains(progressStates, data.State) {
+		return protocolError("invalid-payload", "unknown state %s", data.State)
+	}
+
+	active := d.clientUsingPhone == clientType && d.clientConnection == connection
+
+	var record *callRecord
+	if active {
+		record = d.activeCall
+	} else if d.threeWay != nil && d.threeWay.client == clientType && d.threeWay.connection == connection {
+		record = d.threeWay.call
+	}
+
+	// once a client reports progress the call isn't answered until it says so
+	if record != nil && record.Direction == "outbound" {
+		record.reportsAnswer = true
+	}
+
+	switch data.State {
+	case "ringing":
+		if active {
+			d.audio.Play(&toneSource{
+				frequencies: dialingFrequencies,
+				onOff:       dialingOnOff,
+			})
+		}
+	case "answered":
+		if record != nil && record.Answer == nil {
+			answered := time.Now()
+			record.Answer = &answered
+		}
+
+		if active {
+			d.audio.Stop()
+		}
+	default:
+		if data.State == "error" {
+			d.reportError(fmt.Sprintf("Call through client %s failed: %s", clientType, data.Reason))
+		} else {
+			slog.Info(fmt.Sprintf("[%s] Call through client %s ended: %s", d.serial, clientType, data.State))
+		}
+
+		if record != nil {
+			record.Reason = data.Reason
+		}
+
+		inThreeWay := d.threeWay != nil
+
+		if active {
+			d.finishCall(progressDispositions[data.State])
+		} else if record != nil {
+			logCall(record, progressDispositions[data.State])
+			d.threeWay.call = nil
+		}
+
+		d.clientEnded(clientType, connection)
+
+		// a failed second call goes back to the first, which has its own audio
+		if active && !inThreeWay && d.inUse {
+			d.audio.Play(newProgressSource(data.State))
+		}
+	}
+
+	return nil
+}
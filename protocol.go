@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// protocolVersion is the websocket protocol spoken by clients that send hello,
+// clients sending [type, payload] tuples without it are version 1
+const protocolVersion = 2
+
+// capabilities are messages only sent to clients that ask for them in hello, version 1 clients get none of them
+var capabilities = []string{"missed", "dnd", "conference", "transfer", "hold"}
+
+// capabilityMessages maps optional messages to the capability that enables them
+var capabilityMessages = map[string]string{
+	"missed":     "missed",
+	"cancelled":  "missed",
+	"dnd":        "dnd",
+	"conference": "conference",
+	"transfer":   "transfer",
+	"hold":       "hold",
+	"resume":     "hold",
+}
+
+//go:embed protocol.schema.json
+var protocolSchema []byte
+
+// wsMessage is the envelope of every version 2 message
+type wsMessage struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`      // set by the client to get an ack or error in reply
+	ReplyTo string          `json:"replyTo,omitempty"` // id of the message an ack, error or hello replies to
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type helloData struct {
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities"`
+	Session      string   `json:"session,omitempty"` // sent by the client to resume a session, always sent back by the switchboard
+	Resumed      bool     `json:"resumed,omitempty"`
+	Label        string   `json:"label,omitempty"` // names the connection, so calls can be routed to it
+}
+
+// wsError is sent in reply to a message that couldn't be handled
+type wsError struct {
+	Code    string `json:"code"` // invalid-message, hello-required, unsupported-version, unknown-type, invalid-payload, no-call, forbidden
+	Message string `json:"message"`
+}
+
+func (e *wsError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func protocolError(code string, format string, a ...any) *wsError {
+	return &wsError{
+		Code:    code,
+		Message: fmt.Sprintf(format, a...),
+	}
+}
+
+// decodePayload unmarshals a message payload, rejecting unknown fields from version 2 clients
+func (c *wsConnection) decodePayload(payload json.RawMessage, v any) error {
+	if len(payload) == 0 {
+		return protocolError("invalid-payload", "missing payload")
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	if c.version >= 2 {
+		decoder.DisallowUnknownFields()
+	}
+
+	err := decoder.Decode(v)
+	if err != nil {
+		return protocolError("invalid-payload", "%s", err)
+	}
+
+	return nil
+}
+
+// supports reports whether the connection should be sent a message type
+func (c *wsConnection) supports(typ string) bool {
+	capability, ok := capabilityMessages[typ]
+	if !ok {
+		return true
+	}
+
+	return slices.Contains(c.capabilities, capability)
+}
+
+// send writes a message in the connection's protocol version, dropping messages it didn't ask for
+func (c *wsConnection) send(typ string, payload any) bool {
+	if !c.supports(typ) {
+		return false
+	}
+
+	if c.version < 2 {
+		if payload == nil {
+			c.write([1]string{typ})
+		} else {
+			c.write([2]any{typ, payload})
+		}
+
+		return true
+	}
+
+	c.reply(wsMessage{Type: typ}, payload)
+
+	return true
+}
+
+func (c *wsConnection) reply(message wsMessage, payload any) {
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return
+		}
+
+		message.Payload = data
+	}
+
+	c.write(message)
+}
+
+func (c *wsConnection) replyError(id string, err error) {
+	wsErr, ok := err.(*wsError)
+	if !ok {
+		wsErr = protocolError("invalid-message", "%s", err)
+	}
+
+	c.reply(wsMessage{Type: "error", ReplyTo: id}, wsErr)
+}
+
+// parseMessage reads either framing, a version 2 envelope or a version 1 [type, payload] tuple
+func (c *wsConnection) parseMessage(data []byte) (wsMessage, error) {
+	var message wsMessage
+
+	data = bytes.TrimSpace(data)
+
+	if len(data) > 0 && data[0] == '[' {
+		if c.version >= 2 {
+			return message, protocolError("invalid-message", "tuples aren't allowed after hello")
+		}
+
+		var parts []json.RawMessage
+		err := json.Unmarshal(data, &parts)
+		if err != nil || len(parts) == 0 || len(parts) > 2 {
+			return message, protocolError("invalid-message", "expected [type, payload]")
+		}
+
+		err = json.Unmarshal(parts[0], &message.Type)
+		if err != nil {
+			return message, protocolError("invalid-message", "type must be a string")
+		}
+
+		if len(parts) == 2 {
+			message.Payload = parts[1]
+		}
+
+		return message, nil
+	}
+
+	err := json.Unmarshal(data, &message)
+	if err != nil {
+		return message, protocolError("invalid-message", "%s", err)
+	}
+
+	if message.Type == "" {
+		return message, protocolError("invalid-message", "missing type")
+	}
+
+	if c.version < 2 && message.Type != "hello" {
+		return message, protocolError("hello-required", "send hello before other messages")
+	}
+
+	return message, nil
+}
+
+// hello negotiates the protocol version and capabilities, resuming the session it names.
+// it returns the connection to carry on with
+func (c *wsConnection) hello(message wsMessage) (*wsConnection, error) {
+	var data helloData
+	err := c.decodePayload(message.Payload, &data)
+	if err != nil {
+		return c, err
+	}
+
+	if data.Version < 2 {
+		return c, protocolError("unsupported-version", "version %d isn't supported, use %d", data.Version, protocolVersion)
+	}
+
+	conn := c
+	resumed := false
+
+	if data.Session != "" && data.Session != c.session {
+		if previous := c.client.resumable(data.Session, c.token); previous != nil {
+			previous.resume(c)
+			conn = previous
+			resumed = true
+		}
+	}
+
+	if conn.session == "" {
+		conn.session, err = newSessionToken()
+		if err != nil {
+			return conn, err
+		}
+	}
+
+	conn.version = min(data.Version, protocolVersion)
+	conn.label = data.Label
+	conn.capabilities = nil
+
+	for _, capability := range data.Capabilities {
+		if slices.Contains(capabilities, capability) {
+			conn.capabilities = append(conn.capabilities, capability)
+		}
+	}
+
+	conn.reply(wsMessage{Type: "hello", ReplyTo: message.ID}, helloData{
+		Version:      conn.version,
+		Capabilities: conn.capabilities,
+		Session:      conn.session,
+		Resumed:      resumed,
+	})
+
+	if resumed {
+		conn.flush()
+	}
+
+	return conn, nil
+}
+
+func handleProtocolSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(protocolSchema)
+}
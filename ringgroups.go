@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+const defaultRingGroupTimeout = 20
+
+type ringGroupConfig struct {
+	Members  []string `yaml:"members"`  // device serials, in hunting order for sequential
+	Clients  []string `yaml:"clients"`  // client types whose calls ring this group
+	Strategy string   `yaml:"strategy"` // simultaneous, sequential, round-robin, least-recently-used
+	Timeout  int      `yaml:"timeout"`  // seconds each member rings before moving on to the next
+}
+
+// round-robin position of each ring group
+var ringGroupCursors = map[string]int{}
+
+func (g *ringGroupConfig) validate() error {
+	switch g.Strategy {
+	case "", "simultaneous", "sequential", "round-robin", "least-recently-used":
+	default:
+		return fmt.Errorf("invalid strategy: %s", g.Strategy)
+	}
+
+	if len(g.Members) == 0 {
+		return fmt.Errorf("no members")
+	}
+
+	if g.Timeout < 0 {
+		return fmt.Errorf("invalid timeout: %d", g.Timeout)
+	}
+
+	if g.Timeout == 0 {
+		g.Timeout = defaultRingGroupTimeout
+	}
+
+	return nil
+}
+
+func validateRingGroups(groups map[string]ringGroupConfig) error {
+	clientGroups := map[string]string{}
+
+	for name, group := range groups {
+		err := group.validate()
+		if err != nil {
+			return fmt.Errorf("ring group %s: %w", name, err)
+		}
+
+		for _, client := range group.Clients {
+			if existing, ok := clientGroups[client]; ok {
+				return fmt.Errorf("client %s is in ring groups %s and %s", client, existing, name)
+			}
+
+			clientGroups[client] = name
+		}
+
+		groups[name] = group
+	}
+
+	return nil
+}
+
+// order returns the members in the order they should be rung
+func (g ringGroupConfig) order(name string, candidates []*device) []*device {
+	var members []*device
+
+	for _, serial := range g.Members {
+		for _, d := range candidates {
+			if d.serial == serial {
+				members = append(members, d)
+			}
+		}
+	}
+
+	switch g.Strategy {
+	case "round-robin":
+		if len(members) > 0 {
+			start := ringGroupCursors[name] % len(members)
+			ringGroupCursors[name] = start + 1
+			members = slices.Concat(members[start:], members[:start])
+		}
+	case "least-recently-used":
+		slices.SortStableFunc(members, func(a, b *device) int {
+			return a.lastCall.Compare(b.lastCall)
+		})
+	}
+
+	return members
+}
+
+// ringGroup returns the ring group requested by the client, or the one its client type belongs to
+func (r ringData) ringGroup() (string, ringGroupConfig, bool) {
+	name := r.Group
+
+	if name == "" {
+		for groupName, group := range config.RingGroups {
+			if slices.Contains(group.Clients, r.clientType) {
+				name = groupName
+				break
+			}
+		}
+	}
+
+	group, ok := config.RingGroups[name]
+
+	return name, group, ok
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"fmt"
+	"log/slog"
 	"slices"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -11,11 +14,39 @@ var ringing ringingList
 type ringingList []ringData
 
 type ringData struct {
-	ID         string        `json:"id"`
-	CallerID   *calleridData `json:"callerId,omitempty"`
-	clientType string
-	clientId   uuid.UUID
-	devices    []*device
+	ID          string        `json:"id"`
+	CallerID    *calleridData `json:"callerId,omitempty"`
+	Cadence     string        `json:"cadence,omitempty"` // name of a ring cadence, overrides the device config
+	Group       string        `json:"group,omitempty"`   // name of a ring group, overrides the group chosen by client type
+	clientType  string
+	clientId    uuid.UUID
+	key         uuid.UUID // identifies the entry to its timers, the ID is chosen by the client and can be reused
+	timers      []ringTimer
+	allowed     []string // serials of the devices the client's token can ring, any if empty
+	devices     []*device
+	rang        []*device // every device the call has rung, logged if it's missed
+	target      *device   // rings only this device, ignoring ring rules and groups
+	hunt        []*device // ring group members that haven't been rung yet
+	huntTimeout time.Duration
+	started     time.Time
+}
+
+// ringTimer moves a ring on from a device once it has rung long enough
+type ringTimer struct {
+	d     *device
+	timer *time.Timer
+}
+
+// stopTimers stops the timers of a device, or every device if nil
+func (r *ringData) stopTimers(d *device) {
+	r.timers = slices.DeleteFunc(r.timers, func(t ringTimer) bool {
+		if d == nil || t.d == d {
+			t.timer.Stop()
+			return true
+		}
+
+		return false
+	})
 }
 
 func (d ringData) Number() string {
@@ -27,48 +58,236 @@ func (d ringData) Number() string {
 }
 
 func (list *ringingList) StartRinging(ringData ringData) {
-	number := ringData.Number()
+	ringData.started = time.Now()
+	ringData.key = uuid.New()
+	groupName, group, hasGroup := ringData.ringGroup()
+	dnd := false
+
+	var candidates []*device
 
 	for _, d := range devices {
-		if d.shouldRing(ringData.clientType, number) {
-			ringData.devices = append(ringData.devices, d)
+		if ringData.target != nil {
+			if d != ringData.target {
+				continue
+			}
+		} else if hasGroup && !slices.Contains(group.Members, d.serial) {
+			continue
+		}
+
+		if len(ringData.allowed) > 0 && !slices.Contains(ringData.allowed, d.serial) {
+			continue
+		}
 
-			if !d.ringing && !d.inUse {
-				d.ring(ringData.CallerID)
+		if ringData.target != nil || d.shouldRing(ringData) {
+			if d.doNotDisturb() {
+				dnd = true
+				continue
 			}
 
-			d.ringing = true
+			candidates = append(candidates, d)
 		}
 	}
 
+	// nobody can answer, so the call isn't kept ringing. the client is told so it can send it to voicemail
+	if len(candidates) == 0 {
+		slog.Info(fmt.Sprintf("No device can ring for call %s from client %s (DND=%t)", ringData.ID, ringData.clientType, dnd))
+
+		if client, ok := clients[ringData.clientType]; ok {
+			if dnd {
+				client.DoNotDisturb(ringData)
+			} else {
+				client.Missed(ringData)
+			}
+		}
+
+		return
+	}
+
+	hunting := ringData.target == nil && hasGroup && group.Strategy != "" && group.Strategy != "simultaneous"
+	if hunting {
+		ringData.hunt = group.order(groupName, candidates)
+		ringData.huntTimeout = time.Duration(group.Timeout) * time.Second
+	}
+
 	*list = append(*list, ringData)
+	i := len(*list) - 1
+
+	if hunting {
+		// with every member busy there's nobody to answer
+		if !list.hunt(i) {
+			list.missed(i)
+		}
+	} else {
+		for _, d := range candidates {
+			list.addDevice(i, d)
+		}
+	}
+}
+
+// addDevice starts ringing a device for a call
+func (list *ringingList) addDevice(i int, d *device) {
+	r := &(*list)[i]
+	r.devices = append(r.devices, d)
+
+	if !slices.Contains(r.rang, d) {
+		r.rang = append(r.rang, d)
+	}
+
+	if timeout := d.config().RingTimeout; timeout > 0 {
+		list.startTimer(i, d, time.Duration(timeout)*time.Second)
+	}
+
+	if !d.ringing && !d.inUse {
+		d.ring(*r)
+	}
+
+	d.ringing = true
+}
+
+// startTimer times out a device ringing for a call after a duration
+func (list *ringingList) startTimer(i int, d *device, duration time.Duration) {
+	r := &(*list)[i]
+	key := r.key
+
+	r.timers = append(r.timers, ringTimer{
+		d: d,
+		timer: time.AfterFunc(duration, func() {
+			mu.Lock()
+			list.timeout(key, d)
+			mu.Unlock()
+		}),
+	})
+}
+
+// hunt rings the next available ring group member, returning false once there are none left
+func (list *ringingList) hunt(i int) bool {
+	r := &(*list)[i]
+
+	for len(r.hunt) > 0 {
+		d := r.hunt[0]
+		r.hunt = r.hunt[1:]
+
+		// busy members are skipped
+		if d.inUse {
+			continue
+		}
+
+		list.addDevice(i, d)
+		list.startTimer(i, d, r.huntTimeout)
+
+		return true
+	}
+
+	return false
+}
+
+// release stops the device ringing if no other call is ringing it
+func (list *ringingList) release(d *device) {
+	_, ringIndex := list.Ringing(d)
+	if ringIndex == -1 {
+		d.ringing = false
+		if !d.inUse {
+			d.stopRinging()
+		}
+	}
 }
 
 func (list *ringingList) stopRinging(i int) {
 	ringData := (*list)[i]
+	ringData.stopTimers(nil)
 
 	*list = append((*list)[:i], (*list)[i+1:]...)
 
 	for _, d := range ringData.devices {
-		_, ringIndex := list.Ringing(d)
-		if ringIndex == -1 {
-			d.ringing = false
-			if !d.inUse {
-				d.stopRinging()
-			}
-		}
+		list.release(d)
+	}
+}
+
+// timeout stops ringing a device once its ring timeout is reached, moving on to the next ring group member.
+// the call is missed when no devices are left
+func (list *ringingList) timeout(key uuid.UUID, d *device) {
+	i := slices.IndexFunc(*list, func(r ringData) bool {
+		return r.key == key
+	})
+	if i == -1 {
+		return
+	}
+
+	r := &(*list)[i]
+	if !slices.Contains(r.devices, d) {
+		return
+	}
+
+	r.devices = slices.DeleteFunc(r.devices, func(rd *device) bool {
+		return rd == d
+	})
+	r.stopTimers(d)
+
+	list.release(d)
+
+	if len(r.devices) == 0 && !list.hunt(i) {
+		list.missed(i)
+	}
+}
+
+// missed removes a call nobody answered, logging it for every device it rang and letting the client know
+func (list *ringingList) missed(i int) {
+	missed := (*list)[i]
+	missed.stopTimers(nil)
+
+	*list = append((*list)[:i], (*list)[i+1:]...)
+
+	logMissedCall(missed)
+	slog.Info(fmt.Sprintf("Missed call %s from client %s", missed.ID, missed.clientType))
+
+	if client, ok := clients[missed.clientType]; ok {
+		client.Missed(missed)
 	}
 }
 
 func (list *ringingList) StopRinging(id string) {
 	for i := range *list {
 		if (*list)[i].ID == id {
+			logMissedCall((*list)[i])
 			list.stopRinging(i)
 			break
 		}
 	}
 }
 
+// StopRingingFrom stops a call started by a connection, reporting whether it had one with the id
+func (list *ringingList) StopRingingFrom(id string, clientId uuid.UUID) bool {
+	for i := range *list {
+		if (*list)[i].ID == id && (*list)[i].clientId == clientId {
+			logMissedCall((*list)[i])
+			list.stopRinging(i)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Cancel removes a call without logging it as missed, used when a call is replaced by another
+func (list *ringingList) Cancel(id string) {
+	for i := range *list {
+		if (*list)[i].ID == id {
+			list.stopRinging(i)
+			break
+		}
+	}
+}
+
+// StopRingingClient removes every call that was started by a connection
+func (list *ringingList) StopRingingClient(clientId uuid.UUID) {
+	for i := len(*list) - 1; i >= 0; i-- {
+		if (*list)[i].clientId == clientId {
+			logMissedCall((*list)[i])
+			list.stopRinging(i)
+		}
+	}
+}
+
 func (list *ringingList) Ringing(d *device) (ringData, int) {
 	for i, ringData := range *list {
 		if slices.Contains(ringData.devices, d) {
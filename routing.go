@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+)
+
+type routingConfig struct {
+	Policy string `yaml:"policy"` // first, label, recent, round-robin, affinity
+	Label  string `yaml:"label"`  // connection the label policy prefers
+}
+
+func (r routingConfig) validate() error {
+	switch r.Policy {
+	case "", "first", "recent", "round-robin", "affinity":
+	case "label":
+		if r.Label == "" {
+			return fmt.Errorf("no label")
+		}
+	default:
+		return fmt.Errorf("invalid policy: %s", r.Policy)
+	}
+
+	return nil
+}
+
+func validateRouting(routing map[string]routingConfig) error {
+	for clientType, r := range routing {
+		err := r.validate()
+		if err != nil {
+			return fmt.Errorf("routing for client %s: %w", clientType, err)
+		}
+	}
+
+	return nil
+}
+
+// route picks the connection a call from a device is placed through, nil if none are free. mu must be held
+func (c *wsAggregatorClient) route(d *device) *wsConnection {
+	var available []*wsConnection
+
+	for _, conn := range c.connections {
+		if conn.currentDevice == nil && conn.socket != nil && conn.canCall(d) {
+			available = append(available, conn)
+		}
+	}
+
+	if len(available) == 0 {
+		return nil
+	}
+
+	routing := config.Routing[c.typ]
+	conn := available[0]
+
+	switch routing.Policy {
+	case "label":
+		// falls back to the most recently active when the pinned connection isn't free
+		conn = mostRecentlyActive(available)
+
+		for _, candidate := range available {
+			if candidate.label == routing.Label {
+				conn = candidate
+				break
+			}
+		}
+	case "recent":
+		conn = mostRecentlyActive(available)
+	case "round-robin":
+		// the next free connection after the one called last, in the order they connected
+		start := slices.IndexFunc(c.connections, func(conn *wsConnection) bool {
+			return conn.id == c.lastRouted
+		}) + 1
+
+		for i := range c.connections {
+			candidate := c.connections[(start+i)%len(c.connections)]
+			if slices.Contains(available, candidate) {
+				conn = candidate
+				break
+			}
+		}
+	case "affinity":
+		// the connection that last had a call with the device, or the most recently active if none did
+		var last []*wsConnection
+
+		for _, candidate := range available {
+			if candidate.lastDevice == d {
+				last = append(last, candidate)
+			}
+		}
+
+		if len(last) > 0 {
+			conn = mostRecentlyActive(last)
+		} else {
+			conn = mostRecentlyActive(available)
+		}
+	}
+
+	if len(available) > 1 {
+		slog.Info(fmt.Sprintf("[%s] Routed call to connection %s of client %s (Policy=%s,Label=%s)", d.serial, conn.id, c.typ, routing.Policy, conn.label))
+	}
+
+	c.lastRouted = conn.id
+
+	return conn
+}
+
+func mostRecentlyActive(connections []*wsConnection) *wsConnection {
+	conn := connections[0]
+
+	for _, candidate := range connections[1:] {
+		if candidate.lastActive.After(conn.lastActive) {
+			conn = candidate
+		}
+	}
+
+	return conn
+}
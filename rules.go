@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+type timeWindow struct {
+	Days  []string `yaml:"days"`  // mon, tue, wed, thu, fri, sat, sun - every day if empty
+	Start string   `yaml:"start"` // HH:MM, start of the day if empty
+	End   string   `yaml:"end"`   // HH:MM, end of the day if empty. can be before start to span midnight
+}
+
+func parseMinuteOfDay(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w timeWindow) validate() error {
+	for _, day := range w.Days {
+		if !slices.Contains(weekdays, day) {
+			return fmt.Errorf("invalid day: %s", day)
+		}
+	}
+
+	_, err := parseMinuteOfDay(w.Start, 0)
+	if err != nil {
+		return fmt.Errorf("invalid start: %s", w.Start)
+	}
+
+	_, err = parseMinuteOfDay(w.End, 24*60)
+	if err != nil {
+		return fmt.Errorf("invalid end: %s", w.End)
+	}
+
+	return nil
+}
+
+func (w timeWindow) active(t time.Time) bool {
+	start, err := parseMinuteOfDay(w.Start, 0)
+	if err != nil {
+		return false
+	}
+
+	end, err := parseMinuteOfDay(w.End, 24*60)
+	if err != nil {
+		return false
+	}
+
+	now := t.Hour()*60 + t.Minute()
+
+	day := t
+	if end < start && now < end {
+		// spans midnight, so the window started the day before
+		day = t.AddDate(0, 0, -1)
+	}
+
+	if len(w.Days) > 0 && !slices.Contains(w.Days, weekdays[day.Weekday()]) {
+		return false
+	}
+
+	if end < start {
+		return now >= start || now < end
+	}
+
+	return now >= start && now < end
+}
+
+type ringRule struct {
+	Action     string `yaml:"action"`             // allow, deny
+	Client     string `yaml:"client"`             // any client if empty
+	Number     string `yaml:"number"`             // exact number
+	Prefix     string `yaml:"prefix"`             // number prefix
+	Regex      string `yaml:"regex"`              // regexp matched against the number
+	Name       string `yaml:"name"`               // regexp matched against the caller id name
+	NotPresent string `yaml:"number-not-present"` // O (unavailable), P (private) or any
+	Cadence    string `yaml:"cadence"`            // ring cadence for allowed calls
+	timeWindow `yaml:",inline"`
+
+	regex *regexp.Regexp
+	name  *regexp.Regexp
+}
+
+// compile validates the rule and compiles its regexps
+func (r *ringRule) compile() error {
+	if r.Action != "allow" && r.Action != "deny" {
+		return fmt.Errorf("invalid action: %s", r.Action)
+	}
+
+	if r.NotPresent != "" && r.NotPresent != "O" && r.NotPresent != "P" && r.NotPresent != "any" {
+		return fmt.Errorf("invalid number-not-present: %s", r.NotPresent)
+	}
+
+	err := r.timeWindow.validate()
+	if err != nil {
+		return err
+	}
+
+	if r.Regex != "" {
+		r.regex, err = regexp.Compile(r.Regex)
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.Name != "" {
+		r.name, err = regexp.Compile(r.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.Cadence != "" && !cadenceExists(r.Cadence) {
+		return fmt.Errorf("unknown ring cadence %s", r.Cadence)
+	}
+
+	return nil
+}
+
+func (r ringRule) matches(data ringData, now time.Time) bool {
+	number := data.Number()
+
+	var name, notPresent string
+	if data.CallerID != nil {
+		name = data.CallerID.Name
+		notPresent = data.CallerID.NumberNotPresent
+	}
+
+	// a call without caller id, or without a number, is unavailable
+	if notPresent == "" && number == "" {
+		notPresent = "O"
+	}
+
+	return (r.Client == "" || r.Client == data.clientType) &&
+		(r.Number == "" || r.Number == number) &&
+		(r.Prefix == "" || strings.HasPrefix(number, r.Prefix)) &&
+		(r.regex == nil || r.regex.MatchString(number)) &&
+		(r.name == nil || r.name.MatchString(name)) &&
+		(r.NotPresent == "" || (notPresent != "" && (r.NotPresent == "any" || r.NotPresent == notPresent))) &&
+		r.timeWindow.active(now)
+}
+
+// ringListRules converts the legacy ring-list into rules
+func ringListRules(listType string, list []ringListItem) ([]ringRule, string, error) {
+	var action, def string
+
+	switch listType {
+	case "whitelist":
+		action, def = "allow", "deny"
+	case "blacklist":
+		action, def = "deny", "allow"
+	default:
+		return nil, "", fmt.Errorf("invalid ring list type: %s", listType)
+	}
+
+	rules := make([]ringRule, 0, len(list))
+	for _, item := range list {
+		rules = append(rules, ringRule{
+			Action:  action,
+			Client:  item[0],
+			Number:  item[1],
+			Cadence: item[2],
+		})
+	}
+
+	return rules, def, nil
+}
+
+// validate checks the flash, caller id and timeout options, ring rules and dnd schedule, and converts any legacy ring-list into rules
+func (c *deviceConfig) validate() error {
+	if c.RingListType != "" || len(c.RingList) > 0 {
+		rules, def, err := ringListRules(c.RingListType, c.RingList)
+		if err != nil {
+			return err
+		}
+
+		c.RingRules = append(c.RingRules, rules...)
+		if c.RingDefault == "" {
+			c.RingDefault = def
+		}
+	}
+
+	switch c.FlashAction {
+	case "":
+		c.FlashAction = "three-way"
+	case "three-way", "hold":
+	default:
+		return fmt.Errorf("invalid flash-action: %s", c.FlashAction)
+	}
+
+	switch c.CallerIDFormat {
+	case "", "mdmf", "sdmf":
+	default:
+		return fmt.Errorf("invalid caller-id-format: %s", c.CallerIDFormat)
+	}
+
+	switch c.CallerIDStandard {
+	case "", "bell202", "etsi-fsk", "dtmf":
+	default:
+		return fmt.Errorf("invalid caller-id-standard: %s", c.CallerIDStandard)
+	}
+
+	switch c.CallerIDAlerting {
+	case "", "none", "line-reversal", "ring-pulse":
+	default:
+		return fmt.Errorf("invalid caller-id-alerting: %s", c.CallerIDAlerting)
+	}
+
+	err := c.CallerIDCalibration.validate()
+	if err != nil {
+		return err
+	}
+
+	if c.FlashTime < 0 {
+		return fmt.Errorf("invalid flash-time: %d", c.FlashTime)
+	}
+
+	if c.OffHookTimeout < 0 {
+		return fmt.Errorf("invalid off-hook-timeout: %d", c.OffHookTimeout)
+	}
+
+	if c.RingTimeout < 0 {
+		return fmt.Errorf("invalid ring-timeout: %d", c.RingTimeout)
+	}
+
+	switch c.RingDefault {
+	case "":
+		c.RingDefault = "allow"
+	case "allow", "deny":
+	default:
+		return fmt.Errorf("invalid ring-default: %s", c.RingDefault)
+	}
+
+	for i := range c.RingRules {
+		err := c.RingRules[i].compile()
+		if err != nil {
+			return fmt.Errorf("ring rule %d: %w", i+1, err)
+		}
+	}
+
+	for clientType, cadence := range c.ClientCadences {
+		if !cadenceExists(cadence) {
+			return fmt.Errorf("unknown ring cadence %s for client %s", cadence, clientType)
+		}
+	}
+
+	for i, schedule := range c.DNDSchedule {
+		err := schedule.validate()
+		if err != nil {
+			return fmt.Errorf("dnd schedule %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// ringRule returns the first rule matching the call
+func (d *device) ringRule(data ringData) (ringRule, bool) {
+	now := time.Now()
+
+	for _, rule := range d.config().RingRules {
+		if rule.matches(data, now) {
+			return rule, true
+		}
+	}
+
+	return ringRule{}, false
+}
+
+func (d *device) shouldRing(data ringData) bool {
+	if rule, ok := d.ringRule(data); ok {
+		return rule.Action == "allow"
+	}
+
+	return d.config().RingDefault == "allow"
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRingRuleNumberNotPresent(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		notPresent string
+		callerID   *calleridData
+		matches    bool
+	}{
+		{"any without caller id", "any", nil, true},
+		{"any with an empty number", "any", &calleridData{Name: "Someone"}, true},
+		{"any with private", "any", &calleridData{NumberNotPresent: "P"}, true},
+		{"any with a number", "any", &calleridData{Number: "5551234567"}, false},
+		{"O without caller id", "O", nil, true},
+		{"O with an empty number", "O", &calleridData{}, true},
+		{"O with private", "O", &calleridData{NumberNotPresent: "P"}, false},
+		{"P without caller id", "P", nil, false},
+		{"P with an empty number", "P", &calleridData{}, false},
+		{"P with private", "P", &calleridData{NumberNotPresent: "P"}, true},
+		{"unset without caller id", "", nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule := ringRule{Action: "deny", NotPresent: test.notPresent}
+
+			err := rule.compile()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			matches := rule.matches(ringData{CallerID: test.callerID}, now)
+			if matches != test.matches {
+				t.Errorf("matches = %t, want %t", matches, test.matches)
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+)
+
+const defaultListen = "127.0.0.1:5840"
+const defaultTLSCert = "tls-cert.pem"
+const defaultTLSKey = "tls-key.pem"
+
+// defaultOrigins are the web clients, pages served by the switchboard itself are always allowed
+var defaultOrigins = []string{"https://discord.com", "https://*.discord.com", "https://voice.google.com"}
+
+type tlsConfig struct {
+	Cert       string `yaml:"cert"`
+	Key        string `yaml:"key"`
+	SelfSigned bool   `yaml:"self-signed"` // generate a certificate at cert/key if they don't exist
+}
+
+type serverConfig struct {
+	Listen     []string   `yaml:"listen"`      // host:port addresses
+	UnixSocket string     `yaml:"unix-socket"` // path of a unix domain socket to also listen on, without tls
+	TLS        *tlsConfig `yaml:"tls"`
+	Origins    []string   `yaml:"origins"` // allowed browser origins, * for any. https://*.example.com matches subdomains
+}
+
+func (c *serverConfig) validate() error {
+	if len(c.Listen) == 0 && c.UnixSocket == "" {
+		c.Listen = []string{defaultListen}
+	}
+
+	for _, address := range c.Listen {
+		_, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return fmt.Errorf("invalid listen address %s: %w", address, err)
+		}
+	}
+
+	if c.Origins == nil {
+		c.Origins = defaultOrigins
+	}
+
+	if c.TLS != nil {
+		if c.TLS.Cert == "" && c.TLS.Key == "" && c.TLS.SelfSigned {
+			c.TLS.Cert = defaultTLSCert
+			c.TLS.Key = defaultTLSKey
+		}
+
+		if c.TLS.Cert == "" || c.TLS.Key == "" {
+			return fmt.Errorf("tls needs cert and key")
+		}
+	}
+
+	return nil
+}
+
+// originAllowed checks a browser origin against the allowlist, requests without one aren't from a browser
+func originAllowed(r *http.Request, origin string) bool {
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	if u.Host == r.Host {
+		return true
+	}
+
+	for _, allowed := range config.Server.Origins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+
+		if matched, _ := path.Match(allowed, origin); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loadCertificate reads the tls certificate, generating a self-signed one first if needed
+func (c *tlsConfig) loadCertificate(hosts []string) (tls.Certificate, error) {
+	if c.SelfSigned {
+		_, err := os.Stat(c.Cert)
+		if errors.Is(err, os.ErrNotExist) {
+			slog.Info(fmt.Sprintf("Generating a self-signed certificate at %s", c.Cert))
+
+			err = generateCertificate(c.Cert, c.Key, hosts)
+			if err != nil {
+				return tls.Certificate{}, err
+			}
+		}
+	}
+
+	return tls.LoadX509KeyPair(c.Cert, c.Key)
+}
+
+func generateCertificate(certPath string, keyPath string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "tigerjet-switchboard"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			if !ip.IsUnspecified() {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			}
+		} else if host != "" && host != "localhost" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+// serve listens on every configured address, stopping them all and returning the first error from any of them
+func serve(handler http.Handler) error {
+	c := config.Server
+
+	var tlsConf *tls.Config
+
+	if c.TLS != nil {
+		var hosts []string
+		for _, address := range c.Listen {
+			host, _, _ := net.SplitHostPort(address)
+			hosts = append(hosts, host)
+		}
+
+		cert, err := c.TLS.loadCertificate(hosts)
+		if err != nil {
+			return fmt.Errorf("unable to load tls certificate: %w", err)
+		}
+
+		tlsConf = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	var listeners []net.Listener
+
+	closeListeners := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+
+	for _, address := range c.Listen {
+		l, err := net.Listen("tcp", address)
+		if err != nil {
+			closeListeners()
+			return err
+		}
+
+		if tlsConf != nil {
+			l = tls.NewListener(l, tlsConf)
+		}
+
+		slog.Info(fmt.Sprintf("Listening on %s (TLS=%t)", address, tlsConf != nil))
+		listeners = append(listeners, l)
+	}
+
+	if c.UnixSocket != "" {
+		err := removeStaleSocket(c.UnixSocket)
+		if err != nil {
+			closeListeners()
+			return err
+		}
+
+		l, err := net.Listen("unix", c.UnixSocket)
+		if err != nil {
+			closeListeners()
+			return err
+		}
+
+		slog.Info(fmt.Sprintf("Listening on %s", c.UnixSocket))
+		listeners = append(listeners, l)
+	}
+
+	errs := make(chan error, len(listeners))
+	servers := make([]*http.Server, len(listeners))
+
+	for i, l := range listeners {
+		servers[i] = &http.Server{Handler: handler}
+
+		go func() {
+			errs <- servers[i].Serve(l)
+		}()
+	}
+
+	err := <-errs
+
+	for _, server := range servers {
+		server.Close()
+	}
+
+	return err
+}
+
+// removeStaleSocket removes a socket left behind by a previous run, which would stop listening.
+// anything else at the path is left alone
+func removeStaleSocket(socketPath string) error {
+	info, err := os.Lstat(socketPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("unable to listen on %s: it already exists and isn't a socket", socketPath)
+	}
+
+	return os.Remove(socketPath)
+}
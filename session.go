@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// wsSessionGrace is how long a version 2 client has to reconnect before its calls and rings are ended
+const wsSessionGrace = 30 * time.Second
+
+func newSessionToken() (string, error) {
+	var token [32]byte
+
+	_, err := rand.Read(token[:])
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(token[:]), nil
+}
+
+// detach keeps a disconnected connection's device and rings until it resumes or the grace period ends
+func (conn *wsConnection) detach() {
+	var timer *time.Timer
+	timer = time.AfterFunc(wsSessionGrace, func() {
+		mu.Lock()
+		if conn.socket == nil && conn.expire == timer {
+			slog.Info(fmt.Sprintf("[%s] Session of client %s expired", conn.id, conn.client.typ))
+
+			conn.expire = nil
+			conn.remove()
+		}
+		mu.Unlock()
+	})
+
+	conn.expire = timer
+}
+
+// resumable finds the connection a session token resumes, by a client with the same api token.
+// its old socket may still look alive, since a dropped network is only noticed once pongs stop
+func (c *wsAggregatorClient) resumable(session string, token *apiToken) *wsConnection {
+	for _, conn := range c.connections {
+		if conn.session == session && conn.token.name == token.name {
+			return conn
+		}
+	}
+
+	return nil
+}
+
+// resume moves the socket of a new connection over to the session it reconnected to, closing the old one
+func (conn *wsConnection) resume(from *wsConnection) {
+	if conn.expire != nil {
+		conn.expire.Stop()
+		conn.expire = nil
+	}
+
+	// the old socket's read loop sees it was replaced and leaves the session alone
+	if conn.socket != nil {
+		conn.socket.close()
+	}
+
+	conn.socket = from.socket
+	from.socket = nil
+	from.remove()
+
+	slog.Info(fmt.Sprintf("[%s] Client %s resumed its session", conn.id, conn.client.typ))
+}
+
+// flush sends the messages queued while the client was disconnected
+func (conn *wsConnection) flush() {
+	pending := conn.pending
+	conn.pending = nil
+
+	for _, v := range pending {
+		conn.write(v)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sasha-s/go-deadlock"
+)
+
+func dialHello(t *testing.T, url string, session string) (*websocket.Conn, helloData) {
+	t.Helper()
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ws.WriteJSON(map[string]any{
+		"type":    "hello",
+		"id":      "1",
+		"payload": helloData{Version: 2, Session: session},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reply struct {
+		Type    string    `json:"type"`
+		ReplyTo string    `json:"replyTo"`
+		Payload helloData `json:"payload"`
+	}
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	err = ws.ReadJSON(&reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reply.Type != "hello" || reply.ReplyTo != "1" {
+		t.Fatalf("got %s replying to %s, want a hello reply", reply.Type, reply.ReplyTo)
+	}
+
+	return ws, reply.Payload
+}
+
+func TestResumeWhileOldSocketAlive(t *testing.T) {
+	const clientType = "test-resume"
+
+	// both sockets' handlers take mu at once while the old one is closed, which is expected here
+	deadlock.Opts.Disable = true
+	defer func() { deadlock.Opts.Disable = false }()
+
+	server := httptest.NewServer(http.HandlerFunc(handleWebSocketConnection))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?client=" + clientType
+
+	old, first := dialHello(t, url, "")
+	defer old.Close()
+
+	mu.Lock()
+	client := clients[clientType].(*wsAggregatorClient)
+	original := client.connections[0]
+	d := &device{serial: "test"}
+	original.currentDevice = d
+	mu.Unlock()
+
+	// the old socket is still open, as if the network dropped without the server noticing
+	current, second := dialHello(t, url, first.Session)
+	defer current.Close()
+
+	if !second.Resumed {
+		t.Fatal("session wasn't resumed")
+	}
+
+	if second.Session != first.Session {
+		t.Errorf("session = %s, want %s", second.Session, first.Session)
+	}
+
+	mu.Lock()
+	connections := len(client.connections)
+	kept := connections > 0 && client.connections[0] == original && original.currentDevice == d
+	mu.Unlock()
+
+	if connections != 1 || !kept {
+		t.Errorf("got %d connections, want only the resumed one with its device", connections)
+	}
+
+	old.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, _, err := old.ReadMessage()
+	if err == nil {
+		t.Error("old socket is still open")
+	}
+
+	mu.Lock()
+	original.currentDevice = nil
+	delete(clients, clientType)
+	mu.Unlock()
+}
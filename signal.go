@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+	"unsafe"
+)
+
+const fskBaud = 1200
+
+type fskModem struct {
+	mark  float64
+	space float64
+}
+
+var bell202Modem = fskModem{mark: 1200, space: 2200}
+var v23Modem = fskModem{mark: 1300, space: 2100}
+
+var dtmfFrequencies = map[byte][2]float64{
+	'1': {697, 1209}, '2': {697, 1336}, '3': {697, 1477}, 'A': {697, 1633},
+	'4': {770, 1209}, '5': {770, 1336}, '6': {770, 1477}, 'B': {770, 1633},
+	'7': {852, 1209}, '8': {852, 1336}, '9': {852, 1477}, 'C': {852, 1633},
+	'*': {941, 1209}, '0': {941, 1336}, '#': {941, 1477}, 'D': {941, 1633},
+}
+
+// dual tone alerting signal, sent ahead of on-hook caller ID by ETSI and BT networks
+var dtasFrequencies = []float64{2130, 2750}
+
+var confirmationFrequencies = []float64{350, 440}
+
+// special information tone segments, played rising ahead of an intercept for an unreachable number
+var sitFrequencies = []float64{913.8, 1370.6, 1776.7}
+var sitDurations = []time.Duration{274 * time.Millisecond, 274 * time.Millisecond, 380 * time.Millisecond}
+
+// signalWriter generates phase continuous PCM for modem and tone signaling
+type signalWriter struct {
+	level   float64
+	samples []int16
+	end     float64
+	phase   float64
+}
+
+func (w *signalWriter) write(frequencies []float64, samples float64) {
+	w.end += samples
+
+	for float64(len(w.samples)) < w.end {
+		point := float64(0)
+
+		if len(frequencies) == 1 {
+			point = math.Sin(w.phase)
+			w.phase += frequencies[0] / sampleRate * math.Pi * 2
+		} else {
+			t := float64(len(w.samples)) / sampleRate
+			for _, freq := range frequencies {
+				// split the level between the tones so they don't clip when summed
+				point += math.Sin(t*freq*math.Pi*2) / float64(len(frequencies))
+			}
+		}
+
+		w.samples = append(w.samples, int16(math.Round(point*w.level*32767)))
+	}
+}
+
+func (w *signalWriter) Tone(frequencies []float64, d time.Duration) {
+	w.write(frequencies, d.Seconds()*sampleRate)
+}
+
+func (w *signalWriter) Silence(d time.Duration) {
+	w.write(nil, d.Seconds()*sampleRate)
+}
+
+func (w *signalWriter) Bit(m fskModem, bit bool) {
+	freq := m.space
+	if bit {
+		freq = m.mark
+	}
+
+	w.write([]float64{freq}, float64(sampleRate)/fskBaud)
+}
+
+// Seizure writes the channel seizure signal: alternating space and mark bits
+func (w *signalWriter) Seizure(m fskModem, bits int) {
+	for i := 0; i < bits; i++ {
+		w.Bit(m, i%2 == 1)
+	}
+}
+
+func (w *signalWriter) Mark(m fskModem, bits int) {
+	for i := 0; i < bits; i++ {
+		w.Bit(m, true)
+	}
+}
+
+// Byte writes an asynchronously framed byte: a start bit, 8 data bits (LSB first) and a stop bit
+func (w *signalWriter) Byte(m fskModem, b byte) {
+	w.Bit(m, false)
+
+	for i := 0; i < 8; i++ {
+		w.Bit(m, b&(1<<i) != 0)
+	}
+
+	w.Bit(m, true)
+}
+
+func (w *signalWriter) DTMF(digits string, on time.Duration, off time.Duration) {
+	for i := 0; i < len(digits); i++ {
+		frequencies, ok := dtmfFrequencies[digits[i]]
+		if !ok {
+			continue
+		}
+
+		w.Tone(frequencies[:], on)
+		w.Silence(off)
+	}
+}
+
+func (w *signalWriter) Bytes() []byte {
+	if len(w.samples) == 0 {
+		return nil
+	}
+
+	return unsafe.Slice((*byte)(unsafe.Pointer(&w.samples[0])), len(w.samples)*2)
+}
+
+// pcmSource plays a pre-generated buffer once, or repeatedly if looping
+type pcmSource struct {
+	data   []byte
+	offset int
+	loop   bool
+}
+
+func (s *pcmSource) Read(bytes []byte) (done bool) {
+	n := copy(bytes, s.data[s.offset:])
+	s.offset += n
+
+	for s.loop && n < len(bytes) {
+		s.offset = copy(bytes[n:], s.data)
+		n += s.offset
+	}
+
+	clear(bytes[n:])
+
+	return !s.loop && s.offset >= len(s.data)
+}
+
+func newFSKCallerIDSource(data calleridData, format string, m fskModem, cal callerIDCalibration) (*pcmSource, error) {
+	payload, err := calleridDataToBytes(data, format)
+	if err != nil {
+		return nil, err
+	}
+
+	w := signalWriter{level: cal.Level}
+
+	w.Seizure(m, cal.Seizure)
+	w.Mark(m, cal.Mark)
+
+	for _, b := range payload {
+		w.Byte(m, b)
+	}
+
+	w.Mark(m, 10)
+
+	return &pcmSource{data: w.Bytes()}, nil
+}
+
+func newDTMFCallerIDSource(data calleridData, cal callerIDCalibration) (*pcmSource, error) {
+	digits, err := calleridDataToDTMF(data)
+	if err != nil {
+		return nil, err
+	}
+
+	w := signalWriter{level: cal.Level}
+
+	w.DTMF(digits, 70*time.Millisecond, 70*time.Millisecond)
+
+	return &pcmSource{data: w.Bytes()}, nil
+}
+
+func newDTASSource(level float64) *pcmSource {
+	w := signalWriter{level: level}
+
+	w.Tone(dtasFrequencies, 100*time.Millisecond)
+	w.Silence(100 * time.Millisecond)
+
+	return &pcmSource{data: w.Bytes()}
+}
+
+// newTypeIICallerIDSource sends caller ID to an off-hook phone. the CPE alerting signal asks it to mute the handset,
+// then the message follows without a channel seizure
+func newTypeIICallerIDSource(data calleridData, standard string, format string, cal callerIDCalibration) (*pcmSource, error) {
+	var m fskModem
+
+	switch standard {
+	case "", "bell202":
+		m = bell202Modem
+	case "etsi-fsk":
+		m = v23Modem
+	default:
+		return nil, fmt.Errorf("type II caller id isn't supported with the %s standard", standard)
+	}
+
+	payload, err := calleridDataToBytes(data, format)
+	if err != nil {
+		return nil, err
+	}
+
+	w := signalWriter{level: cal.Level}
+
+	// the alerting signal is the same dual tone as the DTAS
+	w.Tone(dtasFrequencies, 80*time.Millisecond)
+
+	// the phone acknowledges with a DTMF digit within 160ms, which can't be heard here, so wait as if it had
+	w.Silence(250 * time.Millisecond)
+
+	w.Mark(m, 80)
+
+	for _, b := range payload {
+		w.Byte(m, b)
+	}
+
+	w.Mark(m, 10)
+
+	return &pcmSource{data: w.Bytes()}, nil
+}
+
+// newConfirmationSource plays three short bursts of dial tone, used to confirm a feature code
+func newConfirmationSource() *pcmSource {
+	w := signalWriter{level: 0.4}
+
+	for i := 0; i < 3; i++ {
+		w.Tone(confirmationFrequencies, 100*time.Millisecond)
+		w.Silence(100 * time.Millisecond)
+	}
+
+	return &pcmSource{data: w.Bytes()}
+}
+
+func newSITSource() *pcmSource {
+	w := signalWriter{level: 0.4}
+
+	for i, frequency := range sitFrequencies {
+		w.Tone([]float64{frequency}, sitDurations[i])
+	}
+
+	w.Silence(time.Second)
+
+	return &pcmSource{data: w.Bytes()}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const defaultFlashTime = 800
+
+// threeWayCall holds the first call while a second party is dialed and conferenced in
+type threeWayCall struct {
+	client      string
+	connection  uuid.UUID // tells the calls apart when both are on the same client
+	call        *callRecord
+	conferenced bool
+}
+
+type conferenceLeg struct {
+	Client string `json:"client"`
+	Number string `json:"number"`
+}
+
+type conferenceData struct {
+	Device audioDeviceIds  `json:"device"`
+	Legs   []conferenceLeg `json:"legs"` // a single leg means the conference has ended
+
+	connection uuid.UUID // connection with the leg the message is sent to, for clients with several
+}
+
+func (d *device) flashTime() time.Duration {
+	if flashTime := d.config().FlashTime; flashTime > 0 {
+		return time.Duration(flashTime) * time.Millisecond
+	}
+
+	return defaultFlashTime * time.Millisecond
+}
+
+// flash handles a hook flash: the first starts dialing a second party, the second conferences them
+// and another drops the second party. calls that can't be conferenced stay as they are.
+// with the hold flash action it holds and resumes the call instead
+func (d *device) flash() {
+	publish("hook", d, hookEvent{OffHook: true, Flash: true})
+
+	switch {
+	case d.onHold:
+		d.resume()
+	case d.threeWay == nil && d.config().FlashAction == "hold":
+		d.hold()
+	case d.threeWay == nil:
+		client, ok := clients[d.clientUsingPhone]
+		if !ok {
+			return
+		}
+
+		client.Hold(d, d.clientConnection)
+
+		d.threeWay = &threeWayCall{
+			client:     d.clientUsingPhone,
+			connection: d.clientConnection,
+			call:       d.activeCall,
+		}
+
+		d.clientUsingPhone = ""
+		d.clientConnection = uuid.Nil
+		d.activeCall = nil
+		d.dialer = d.config().Dialer
+		d.dialpad = ""
+
+		d.audio.Play(&toneSource{
+			frequencies: config.Dialers[d.dialer].DialTone,
+			onOff:       stutterOnOff,
+			onOffFor:    sampleRate,
+		})
+		d.dialTone = true
+
+		slog.Info(fmt.Sprintf("[%s] Three-way calling, dialing second party", d.serial))
+	case !d.threeWay.conferenced && d.clientUsingPhone != "":
+		// dropping the second party here would hang up on them without warning
+		if !d.canConference() {
+			d.reportError(fmt.Sprintf("Clients %s and %s can't be conferenced, staying with the second party", d.threeWay.client, d.clientUsingPhone))
+			return
+		}
+
+		d.threeWay.conferenced = true
+		d.audio.Stop()
+
+		if client, ok := clients[d.threeWay.client]; ok {
+			client.Resume(d, d.threeWay.connection)
+		}
+
+		slog.Info(fmt.Sprintf("[%s] Conferencing clients %s and %s", d.serial, d.threeWay.client, d.clientUsingPhone))
+
+		d.sendConference()
+	default:
+		slog.Info(fmt.Sprintf("[%s] Dropping second party, back to client %s", d.serial, d.threeWay.client))
+
+		if client, ok := clients[d.clientUsingPhone]; ok {
+			client.End(d, d.clientConnection)
+		}
+
+		d.endCall()
+		d.resumeFirstCall()
+	}
+}
+
+// resumeFirstCall goes back to the first call after the second party is gone
+func (d *device) resumeFirstCall() {
+	conferenced := d.threeWay.conferenced
+
+	d.dialer = ""
+	d.dialpad = ""
+	d.dialTone = false
+	d.audio.Stop()
+
+	d.clientUsingPhone = d.threeWay.client
+	d.clientConnection = d.threeWay.connection
+	d.activeCall = d.threeWay.call
+	d.threeWay = nil
+
+	if conferenced {
+		d.sendConference()
+	} else if client, ok := clients[d.clientUsingPhone]; ok {
+		client.Resume(d, d.clientConnection)
+	}
+}
+
+// canConference reports whether the two calls of a three-way call can be conferenced.
+// the switchboard doesn't mix audio, so each call's websocket connection is sent the other call
+// and mixes it in itself. the calls can be on different client types
+func (d *device) canConference() bool {
+	return legConferences(d.threeWay.client, d.threeWay.connection) && legConferences(d.clientUsingPhone, d.clientConnection)
+}
+
+// legConferences reports whether the connection with a call asked for conference messages
+func legConferences(clientType string, connection uuid.UUID) bool {
+	client, ok := clients[clientType].(*wsAggregatorClient)
+	if !ok {
+		return false
+	}
+
+	return client.conferences(connection)
+}
+
+// sendConference tells the connection with each call about every call in the conference
+func (d *device) sendConference() {
+	var legs []conferenceLeg
+
+	addLeg := func(client string, call *callRecord) {
+		leg := conferenceLeg{Client: client}
+		if call != nil {
+			leg.Number = call.Number
+		}
+
+		legs = append(legs, leg)
+	}
+
+	if d.threeWay != nil {
+		addLeg(d.threeWay.client, d.threeWay.call)
+	}
+
+	if d.clientUsingPhone != "" {
+		addLeg(d.clientUsingPhone, d.activeCall)
+	}
+
+	data := conferenceData{
+		Device: d.audioDeviceIds,
+		Legs:   legs,
+	}
+
+	send := func(clientType string, connection uuid.UUID) {
+		if client, ok := clients[clientType]; ok {
+			data.connection = connection
+			client.Conference(d, data)
+		}
+	}
+
+	if d.threeWay != nil {
+		send(d.threeWay.client, d.threeWay.connection)
+	}
+
+	if d.clientUsingPhone != "" {
+		send(d.clientUsingPhone, d.clientConnection)
+	}
+}
+
+// clientEnded handles a client ending its call from the far end
+func (d *device) clientEnded(clientType string, connection uuid.UUID) {
+	transfers.ended(d, clientType, connection)
+
+	current := d.clientUsingPhone == clientType && d.clientConnection == connection
+
+	if d.threeWay == nil {
+		if current {
+			d.clientUsingPhone = ""
+			d.clientConnection = uuid.Nil
+			d.endCall()
+			d.armOffHookTimer()
+		}
+
+		return
+	}
+
+	if current {
+		d.endCall()
+		d.resumeFirstCall()
+	} else if d.threeWay.client == clientType && d.threeWay.connection == connection {
+		if d.threeWay.call != nil {
+			logCall(d.threeWay.call, d.threeWay.call.disposition())
+		}
+
+		conferenced := d.threeWay.conferenced
+		d.threeWay = nil
+
+		if conferenced {
+			d.sendConference()
+		}
+	}
+}
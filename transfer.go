@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/google/uuid"
+)
+
+type transferData struct {
+	Device audioDeviceIds `json:"device"`           // device now handling the call
+	Client string         `json:"client,omitempty"` // set when the far end should be transferred to a number instead
+	Number string         `json:"number,omitempty"`
+
+	connection uuid.UUID // connection with the call, for clients with several
+}
+
+// pendingTransfer is a call waiting for its transfer target, or ringing back the device it came from
+type pendingTransfer struct {
+	id         string
+	from       *device
+	to         *device
+	client     string
+	connection uuid.UUID
+	call       *callRecord
+	recalled   bool
+}
+
+// transferClient rings transfer targets and recalls, handing the call over once answered
+type transferClient struct {
+	pending []*pendingTransfer
+}
+
+var transfers = &transferClient{}
+
+func (c *transferClient) find(id string) *pendingTransfer {
+	for _, t := range c.pending {
+		if t.id == id {
+			return t
+		}
+	}
+
+	return nil
+}
+
+func (c *transferClient) remove(t *pendingTransfer) {
+	c.pending = slices.DeleteFunc(c.pending, func(other *pendingTransfer) bool {
+		return other == t
+	})
+}
+
+func (t *pendingTransfer) callerID() *calleridData {
+	data := &calleridData{}
+	if t.call != nil {
+		data.Number = t.call.Number
+		data.Name = t.call.Name
+	}
+
+	return data
+}
+
+// start transfers the held call to the second party when the device hangs up mid three-way call,
+// returning the transfer if the device should be rung back instead
+func (c *transferClient) start(d *device) *pendingTransfer {
+	t := &pendingTransfer{
+		id:         uuid.New().String(),
+		from:       d,
+		client:     d.threeWay.client,
+		connection: d.threeWay.connection,
+		call:       d.threeWay.call,
+	}
+	d.threeWay = nil
+	c.pending = append(c.pending, t)
+
+	switch {
+	case d.clientUsingPhone == "intercom":
+		call := intercom.callFrom(d)
+		d.clientUsingPhone = ""
+		d.clientConnection = uuid.Nil
+		d.endCall()
+
+		if call == nil {
+			return t
+		}
+
+		t.to = call.callee
+		intercom.remove(call)
+
+		if call.bridge != nil {
+			slog.Info(fmt.Sprintf("[%s] Attended transfer of client %s to %s", d.serial, t.client, t.to.serial))
+			c.complete(t, t.to)
+			return nil
+		}
+
+		slog.Info(fmt.Sprintf("[%s] Blind transfer of client %s to %s", d.serial, t.client, t.to.serial))
+
+		ringing.Cancel(call.id)
+		ringing.StartRinging(ringData{
+			ID:         t.id,
+			CallerID:   t.callerID(),
+			clientType: "transfer",
+			target:     t.to,
+		})
+
+		return nil
+	case d.clientUsingPhone != "" && d.activeCall != nil:
+		// the far end can only be handed over by its client, the second party is ended by the hang up
+		slog.Info(fmt.Sprintf("[%s] Transferring client %s to %s on client %s", d.serial, t.client, d.activeCall.Number, d.clientUsingPhone))
+
+		client, ok := clients[t.client]
+		if !ok || !client.Transfer(d, nil, transferData{
+			Device: d.audioDeviceIds,
+			Client: d.clientUsingPhone,
+			Number: d.activeCall.Number,
+
+			connection: t.connection,
+		}) {
+			slog.Info(fmt.Sprintf("[%s] Client %s can't transfer its call", d.serial, t.client))
+			return t
+		}
+
+		// the client has the call now, so nothing is left to ring back
+		c.remove(t)
+
+		if t.call != nil {
+			logCall(t.call, t.call.disposition())
+		}
+
+		return nil
+	}
+
+	// nothing to transfer to
+	return t
+}
+
+// complete hands the call over to the device that answered it
+func (c *transferClient) complete(t *pendingTransfer, to *device) {
+	c.remove(t)
+
+	if client, ok := clients[t.client]; ok && !client.Transfer(t.from, to, transferData{Device: to.audioDeviceIds, connection: t.connection}) {
+		slog.Warn(fmt.Sprintf("[%s] Client %s can't move its call to %s", t.from.serial, t.client, to.serial))
+	}
+
+	to.endCall()
+	to.clientUsingPhone = t.client
+	to.clientConnection = t.connection
+	to.activeCall = t.call
+	if to.activeCall != nil {
+		to.activeCall.Device = to.serial
+	}
+
+	to.resume()
+
+	slog.Info(fmt.Sprintf("[%s] Transferred client %s from %s", to.serial, t.client, t.from.serial))
+}
+
+// recall rings the device the call came from so it isn't lost
+func (c *transferClient) recall(t *pendingTransfer) {
+	t.recalled = true
+	t.to = nil
+
+	slog.Info(fmt.Sprintf("[%s] Ringing back with client %s", t.from.serial, t.client))
+
+	ringing.StartRinging(ringData{
+		ID:         t.id,
+		CallerID:   t.callerID(),
+		clientType: "transfer",
+		target:     t.from,
+	})
+}
+
+// failed is called when a client couldn't transfer its call to a number
+func (c *transferClient) failed(d *device, clientType string, connection uuid.UUID) {
+	for _, t := range c.pending {
+		if t.from == d && t.client == clientType && t.connection == connection && !t.recalled {
+			c.recall(t)
+			return
+		}
+	}
+}
+
+// ended drops any transfer of a call the far end hung up
+func (c *transferClient) ended(d *device, clientType string, connection uuid.UUID) {
+	for _, t := range c.pending {
+		if t.from != d || t.client != clientType || t.connection != connection {
+			continue
+		}
+
+		c.remove(t)
+		ringing.StopRinging(t.id)
+
+		if t.call != nil {
+			logCall(t.call, t.call.disposition())
+		}
+
+		return
+	}
+}
+
+// abandon ends the call when neither the target nor the original device answered
+func (c *transferClient) abandon(t *pendingTransfer) {
+	c.remove(t)
+
+	slog.Info(fmt.Sprintf("[%s] Ending client %s, transfer wasn't answered", t.from.serial, t.client))
+
+	if client, ok := clients[t.client]; ok {
+		client.End(t.from, t.connection)
+	}
+
+	if t.call != nil {
+		logCall(t.call, t.call.disposition())
+	}
+}
+
+func (c *transferClient) Call(_ *device, _ callData, _ string) {
+}
+
+func (c *transferClient) End(_ *device, _ uuid.UUID) {
+}
+
+func (c *transferClient) Answer(d *device, data callAnswerData) {
+	t := c.find(data.ID)
+	if t == nil {
+		return
+	}
+
+	if !t.recalled {
+		c.complete(t, d)
+		return
+	}
+
+	c.remove(t)
+
+	d.clientUsingPhone = t.client
+	d.clientConnection = t.connection
+	d.activeCall = t.call
+	d.resume()
+}
+
+func (c *transferClient) Missed(data ringData) {
+	c.unavailable(data)
+}
+
+func (c *transferClient) DoNotDisturb(data ringData) {
+	c.unavailable(data)
+}
+
+func (c *transferClient) Cancelled(data ringData) {
+	c.unavailable(data)
+}
+
+func (c *transferClient) unavailable(data ringData) {
+	t := c.find(data.ID)
+	if t == nil {
+		return
+	}
+
+	if t.recalled {
+		c.abandon(t)
+	} else {
+		c.recall(t)
+	}
+}
+
+func (c *transferClient) Conference(_ *device, _ conferenceData) {
+}
+
+func (c *transferClient) Transfer(_ *device, _ *device, _ transferData) bool {
+	return false
+}
+
+func (c *transferClient) Hold(_ *device, _ uuid.UUID) {
+}
+
+func (c *transferClient) Resume(_ *device, _ uuid.UUID) {
+}
+
+func (c *transferClient) InUse(_ *device) bool {
+	return false
+}
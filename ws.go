@@ -1,59 +1,239 @@
 package main
 
 import (
-	"encoding/json"
+	"bytes"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/go-chi/render"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
+const wsWriteWait = 10 * time.Second
+const wsPongWait = 60 * time.Second
+const wsPingPeriod = wsPongWait * 9 / 10
+
+// wsQueueSize is how many messages can wait to be written before the connection is considered stuck
+const wsQueueSize = 64
+
 type wsAggregatorClient struct {
 	connections []*wsConnection
 	typ         string
+	lastRouted  uuid.UUID // connection the last call was routed to, for round-robin
 }
 
 type wsConnection struct {
 	id            uuid.UUID
-	ws            *websocket.Conn
+	socket        *wsSocket // nil while waiting for the client to resume its session
 	client        *wsAggregatorClient
 	currentDevice *device
+	version       int      // 1 until the client sends hello
+	capabilities  []string // optional messages the client asked for
+	subscriptions []string // events pushed to the client
+	token         *apiToken
+	session       string // token the client resumes the connection with after reconnecting
+	pending       []any  // messages waiting for the client to resume
+	expire        *time.Timer
+	label         string    // sent by the client in hello, calls can be pinned to it
+	lastActive    time.Time // when the client last sent a message
+	lastDevice    *device   // device of the connection's last call, for affinity
+	sendsProgress bool      // the client has reported call progress, so its calls aren't answered until it says
+}
+
+// wsSocket is a single websocket, owned by a connection until it disconnects
+type wsSocket struct {
+	ws        *websocket.Conn
+	queue     chan any
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newWSSocket(ws *websocket.Conn) *wsSocket {
+	return &wsSocket{
+		ws:     ws,
+		queue:  make(chan any, wsQueueSize),
+		closed: make(chan struct{}),
+	}
+}
+
+// write queues a message for the writer goroutine, disconnecting clients that stop reading
+func (c *wsConnection) write(v any) {
+	if c.socket == nil {
+		if len(c.pending) < wsQueueSize {
+			c.pending = append(c.pending, v)
+		}
+		return
+	}
+
+	select {
+	case c.socket.queue <- v:
+	case <-c.socket.closed:
+	default:
+		slog.Warn(fmt.Sprintf("[%s] Send queue of client %s is full, disconnecting", c.id, c.client.typ))
+		c.socket.close()
+	}
+}
+
+func (s *wsSocket) close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.ws.Close()
+	})
+}
+
+// writeLoop is the only writer of the socket, also sending pings so dead connections are noticed
+func (s *wsSocket) writeLoop() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case v := <-s.queue:
+			s.ws.SetWriteDeadline(time.Now().Add(wsWriteWait))
+
+			err := s.ws.WriteJSON(v)
+			if err != nil {
+				s.close()
+				return
+			}
+		case <-ticker.C:
+			err := s.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+			if err != nil {
+				s.close()
+				return
+			}
+		case <-s.closed:
+			return
+		}
+	}
 }
 
 func (c *wsAggregatorClient) Call(d *device, data callData, _ string) {
+	conn := c.route(d)
+	if conn == nil {
+		return
+	}
+
+	conn.currentDevice = d
+	conn.lastDevice = d
+	d.clientConnection = conn.id
+
+	if conn.sendsProgress && d.activeCall != nil {
+		d.activeCall.reportsAnswer = true
+	}
+
+	conn.send("call", data)
+}
+
+// leg finds the connection with a call on a device. a device can have a call on two connections
+// during a three-way call, so the connection is matched too unless it's uuid.Nil
+func (c *wsAggregatorClient) leg(d *device, connection uuid.UUID) *wsConnection {
+	for _, conn := range c.connections {
+		if conn.currentDevice == d && (connection == uuid.Nil || conn.id == connection) {
+			return conn
+		}
+	}
+
+	return nil
+}
+
+// conferences reports whether a connection asked for conference messages, so it can mix a conference
+func (c *wsAggregatorClient) conferences(connection uuid.UUID) bool {
+	for _, conn := range c.connections {
+		if conn.id == connection {
+			return conn.supports("conference")
+		}
+	}
+
+	return false
+}
+
+func (c *wsAggregatorClient) End(d *device, connection uuid.UUID) {
+	if conn := c.leg(d, connection); conn != nil {
+		conn.currentDevice = nil
+		conn.send("end", nil)
+	}
+}
+
+func (c *wsAggregatorClient) Answer(d *device, data callAnswerData) {
 	for _, c := range c.connections {
-		if c.currentDevice == nil {
+		if c.id == data.ringData.clientId {
 			c.currentDevice = d
-			c.ws.WriteJSON([2]any{"call", data})
+			c.lastDevice = d
+			c.send("answer", data)
 			break
 		}
 	}
 }
 
-func (c *wsAggregatorClient) End(d *device) {
+func (c *wsAggregatorClient) Missed(data ringData) {
 	for _, c := range c.connections {
-		if c.currentDevice == d {
-			c.currentDevice = nil
-			c.ws.WriteJSON([1]string{"end"})
+		if c.id == data.clientId {
+			c.send("missed", data.ID)
 			break
 		}
 	}
 }
 
-func (c *wsAggregatorClient) Answer(d *device, data callAnswerData) {
+func (c *wsAggregatorClient) DoNotDisturb(data ringData) {
 	for _, c := range c.connections {
-		if c.id == data.ringData.clientId {
-			c.currentDevice = d
-			c.ws.WriteJSON([2]any{"answer", data})
+		if c.id == data.clientId {
+			c.send("dnd", data.ID)
 			break
 		}
 	}
 }
 
-func (c *wsAggregatorClient) InUse() bool {
+func (c *wsAggregatorClient) Cancelled(data ringData) {
 	for _, c := range c.connections {
-		if c.currentDevice == nil {
+		if c.id == data.clientId {
+			c.send("cancelled", data.ID)
+			break
+		}
+	}
+}
+
+func (c *wsAggregatorClient) Conference(d *device, data conferenceData) {
+	if conn := c.leg(d, data.connection); conn != nil {
+		conn.send("conference", data)
+	}
+}
+
+func (c *wsAggregatorClient) Transfer(from *device, to *device, data transferData) bool {
+	conn := c.leg(from, data.connection)
+	if conn == nil || !conn.supports("transfer") {
+		return false
+	}
+
+	if to != nil {
+		conn.currentDevice = to
+	}
+
+	conn.send("transfer", data)
+	return true
+}
+
+func (c *wsAggregatorClient) Hold(d *device, connection uuid.UUID) {
+	if conn := c.leg(d, connection); conn != nil {
+		conn.send("hold", nil)
+	}
+}
+
+func (c *wsAggregatorClient) Resume(d *device, connection uuid.UUID) {
+	if conn := c.leg(d, connection); conn != nil {
+		conn.send("resume", nil)
+	}
+}
+
+// InUse matches route, so a call is only placed when a connection can take it
+func (c *wsAggregatorClient) InUse(d *device) bool {
+	for _, conn := range c.connections {
+		if conn.currentDevice == nil && conn.socket != nil && conn.canCall(d) {
 			return false
 		}
 	}
@@ -61,9 +241,136 @@ func (c *wsAggregatorClient) InUse() bool {
 	return true
 }
 
+// canCall reports whether calls can be placed through the connection from a device
+func (c *wsConnection) canCall(d *device) bool {
+	return c.token.hasScope("call") && c.token.allowsDevice(d)
+}
+
+// handle runs a message from the client, mu must be held
+func (conn *wsConnection) handle(message wsMessage) error {
+	clientType := conn.client.typ
+
+	switch message.Type {
+	case "ring":
+		if !conn.token.hasScope("ring") {
+			return protocolError("forbidden", "token %s is missing the ring scope", conn.token.name)
+		}
+
+		var ringData ringData
+		err := conn.decodePayload(message.Payload, &ringData)
+		if err != nil {
+			return err
+		}
+
+		if ringData.Cadence != "" && !cadenceExists(ringData.Cadence) {
+			return protocolError("invalid-payload", "unknown ring cadence %s", ringData.Cadence)
+		}
+
+		ringData.clientType = clientType
+		ringData.clientId = conn.id
+		ringData.allowed = conn.token.Devices
+
+		ringing.StartRinging(ringData)
+	case "stopRinging":
+		if !conn.token.hasScope("ring") {
+			return protocolError("forbidden", "token %s is missing the ring scope", conn.token.name)
+		}
+
+		var id string
+		err := conn.decodePayload(message.Payload, &id)
+		if err != nil {
+			return err
+		}
+
+		// a connection can only stop its own rings, ids are chosen by clients and can clash
+		if !ringing.StopRingingFrom(id, conn.id) {
+			if slices.ContainsFunc(ringing, func(r ringData) bool { return r.ID == id }) {
+				return protocolError("forbidden", "ring %s was started by another connection", id)
+			}
+
+			return protocolError("not-found", "no ring %s", id)
+		}
+	case "dialing":
+		var dialing bool
+		err := conn.decodePayload(message.Payload, &dialing)
+		if err != nil {
+			return err
+		}
+
+		if conn.currentDevice == nil {
+			return protocolError("no-call", "not in a call")
+		}
+
+		if dialing {
+			conn.currentDevice.audio.Play(&toneSource{
+				frequencies: dialingFrequencies,
+				onOff:       dialingOnOff,
+			})
+		} else {
+			conn.currentDevice.audio.Stop()
+		}
+	case "progress":
+		var data progressData
+		err := conn.decodePayload(message.Payload, &data)
+		if err != nil {
+			return err
+		}
+
+		if conn.currentDevice == nil {
+			return protocolError("no-call", "not in a call")
+		}
+
+		conn.sendsProgress = true
+
+		err = conn.currentDevice.progress(clientType, conn.id, data)
+		if err != nil {
+			return err
+		}
+
+		// the call is over once it fails
+		if _, ended := progressDispositions[data.State]; ended {
+			conn.currentDevice = nil
+		}
+	case "subscribe":
+		var data subscriptionData
+		err := conn.decodePayload(message.Payload, &data)
+		if err != nil {
+			return err
+		}
+
+		return conn.subscribe(data)
+	case "unsubscribe":
+		var data subscriptionData
+		if len(message.Payload) > 0 {
+			err := conn.decodePayload(message.Payload, &data)
+			if err != nil {
+				return err
+			}
+		}
+
+		conn.unsubscribe(data)
+	case "transferFailed":
+		if conn.currentDevice == nil {
+			return protocolError("no-call", "not in a call")
+		}
+
+		transfers.failed(conn.currentDevice, clientType, conn.id)
+	case "end":
+		if conn.currentDevice == nil {
+			return protocolError("no-call", "not in a call")
+		}
+
+		conn.currentDevice.clientEnded(clientType, conn.id)
+		conn.currentDevice = nil
+	default:
+		return protocolError("unknown-type", "unknown message type %s", message.Type)
+	}
+
+	return nil
+}
+
 func handleWebSocketConnection(w http.ResponseWriter, r *http.Request) {
 	clientType := r.URL.Query().Get("client")
-	secret := r.URL.Query().Get("secret")
 
 	if clientType == "" {
 		render.Status(r, http.StatusBadRequest)
@@ -71,9 +378,15 @@ func handleWebSocketConnection(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if secret != config.Secret {
-		render.Status(r, http.StatusUnauthorized)
-		render.PlainText(w, r, "invalid secret")
+	token, ok := authorize(w, r, "")
+	if !ok {
+		return
+	}
+
+	if !token.allowsClient(clientType) {
+		slog.Warn(fmt.Sprintf("[auth] Token %s denied connecting as client %s", token.name, clientType))
+		render.Status(r, http.StatusForbidden)
+		render.PlainText(w, r, "token can't connect as this client type")
 		return
 	}
 
@@ -83,6 +396,7 @@ func handleWebSocketConnection(w http.ResponseWriter, r *http.Request) {
 
 	if existing, ok := clients[clientType]; ok {
 		if client, ok = existing.(*wsAggregatorClient); !ok {
+			mu.Unlock()
 			render.Status(r, http.StatusBadRequest)
 			render.PlainText(w, r, "unable to register as this client type")
 			return
@@ -98,111 +412,113 @@ func handleWebSocketConnection(w http.ResponseWriter, r *http.Request) {
 
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		mu.Unlock()
 		return
 	}
 
+	socket := newWSSocket(ws)
+
 	conn := &wsConnection{
-		id:     uuid.New(),
-		ws:     ws,
-		client: client,
+		id:         uuid.New(),
+		socket:     socket,
+		client:     client,
+		version:    1,
+		token:      token,
+		lastActive: time.Now(),
 	}
 
 	client.connections = append(client.connections, conn)
 
 	mu.Unlock()
 
+	go socket.writeLoop()
+
+	// clients that stop answering pings are disconnected by the read deadline
+	ws.SetReadDeadline(time.Now().Add(wsPongWait))
+	ws.SetPongHandler(func(string) error {
+		ws.SetReadDeadline(time.Now().Add(wsPongWait))
+		return nil
+	})
+
 	for {
-		_, bytes, err := ws.ReadMessage()
+		_, data, err := ws.ReadMessage()
 		if err != nil {
 			break
 		}
 
-		var jsonParts [2]json.RawMessage
-		err = json.Unmarshal(bytes, &jsonParts)
-		if err != nil {
-			break
-		}
+		ws.SetReadDeadline(time.Now().Add(wsPongWait))
+
+		mu.Lock()
 
-		var typ string
+		envelope := conn.version >= 2 || bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+
+		message, err := conn.parseMessage(data)
+		if err == nil {
+			if message.Type == "hello" {
+				// resuming a session carries on with the connection from before the reconnect
+				conn, err = conn.hello(message)
+			} else {
+				err = conn.handle(message)
+			}
+		}
 
-		err = json.Unmarshal(jsonParts[0], &typ)
 		if err != nil {
-			break
+			slog.Warn(fmt.Sprintf("[%s] Message from client %s failed: %s", conn.id, clientType, err))
 		}
 
-		switch typ {
-		case "ring":
-			var ringData ringData
-			err = json.Unmarshal(jsonParts[1], &ringData)
+		conn.lastActive = time.Now()
+
+		// version 1 clients sending tuples don't expect replies
+		if envelope {
 			if err != nil {
-				break
+				conn.replyError(message.ID, err)
+			} else if message.ID != "" && message.Type != "hello" {
+				conn.reply(wsMessage{Type: "ack", ReplyTo: message.ID}, nil)
 			}
+		}
 
-			ringData.clientType = clientType
-			ringData.clientId = conn.id
+		mu.Unlock()
+	}
 
-			mu.Lock()
-			ringing.StartRinging(ringData)
-			mu.Unlock()
-		case "stopRinging":
-			var id string
-			err = json.Unmarshal(jsonParts[1], &id)
-			if err != nil {
-				break
-			}
+	// On Disconnect, including connections evicted for missing pings or a full send queue
 
-			mu.Lock()
-			ringing.StopRinging(id)
-			mu.Unlock()
-		case "dialing":
-			var dialing bool
-			err = json.Unmarshal(jsonParts[1], &dialing)
-			if err != nil {
-				break
-			}
+	mu.Lock()
 
-			mu.Lock()
-			if conn.currentDevice != nil {
-				if dialing {
-					conn.currentDevice.audio.Play(&toneSource{
-						frequencies: dialingFrequencies,
-						onOff:       dialingOnOff,
-					})
-				} else {
-					conn.currentDevice.audio.Stop()
-				}
-			}
-			mu.Unlock()
-		case "end":
-			mu.Lock()
-			if conn.currentDevice != nil {
-				conn.currentDevice.clientUsingPhone = ""
-				conn.currentDevice = nil
-			}
-			mu.Unlock()
+	if conn.socket == socket {
+		conn.socket = nil
+
+		if conn.session != "" {
+			slog.Info(fmt.Sprintf("[%s] Client %s disconnected, keeping its session for %s", conn.id, clientType, wsSessionGrace))
+			conn.detach()
+		} else {
+			slog.Info(fmt.Sprintf("[%s] Client %s disconnected", conn.id, clientType))
+			conn.remove()
 		}
 	}
 
-	// On Disconnect
+	mu.Unlock()
 
-	mu.Lock()
+	socket.close()
+}
 
-	for i, c := range client.connections {
+// remove tears down a connection, ending its calls and anything it was ringing
+func (conn *wsConnection) remove() {
+	clientType := conn.client.typ
+
+	ringing.StopRingingClient(conn.id)
+
+	for i, c := range conn.client.connections {
 		if c == conn {
-			client.connections = append(client.connections[:i], client.connections[i+1:]...)
+			conn.client.connections = append(conn.client.connections[:i], conn.client.connections[i+1:]...)
 
-			if len(client.connections) == 0 {
+			if len(conn.client.connections) == 0 && clients[clientType] == conn.client {
 				delete(clients, clientType)
 			}
 			break
 		}
 	}
 
-	mu.Unlock()
-
 	if conn.currentDevice != nil {
-		conn.currentDevice.clientUsingPhone = ""
+		conn.currentDevice.clientEnded(clientType, conn.id)
 	}
-
-	ws.Close()
 }